@@ -0,0 +1,332 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdt
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/starshiptroopers/ftpdt/ftp"
+	"github.com/starshiptroopers/uidgenerator"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAdminBadTTL = errors.New("wrong ttl value")
+)
+
+// AdminOpts is a management API options
+type AdminOpts struct {
+	Token    string //bearer token required in the Authorization header, it must be set unless Insecure is
+	Insecure bool   //serve the API without the token, e.g. if it's protected by the reverse proxy
+	LinkHost string //host[:port] used in the generated ftp links
+	LinkExt  string //extension of the generated ftp links, "html" is used if empty
+}
+
+// AdminHandler implements the REST API managing the data records:
+//
+//	GET    /records             list the records
+//	POST   /records             create a record with the generated uid
+//	GET    /records/{uid}       read the record
+//	PUT    /records/{uid}       update the record's payload and ttl
+//	DELETE /records/{uid}       delete the record
+//
+// The request body is a JSON object {"template": "example/redirect", "ttl": "24h", "payload": {...}},
+// ttl is a duration string or a number of seconds. The template is only used to build the ftp link,
+// GET accepts it as a "template" query parameter. The links follow the ftp.DefaultRouter layout
+// /<template>/<uid>.<LinkExt>, they may not resolve if the server uses a custom Router.
+// Mount it with http.StripPrefix if it's served under a prefix
+type AdminHandler struct {
+	ds           ftp.WritableDataStorage
+	ts           ftp.TemplateStorage
+	uidGenerator uidgenerator.UID
+	opts         AdminOpts
+	logger       *log.Logger
+}
+
+type adminRequest struct {
+	Template string          `json:"template"`
+	TTL      json.RawMessage `json:"ttl"`
+	Payload  interface{}     `json:"payload"`
+}
+
+type adminRecord struct {
+	Uid       string      `json:"uid"`
+	Template  string      `json:"template,omitempty"`
+	Link      string      `json:"link,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+	TTL       int64       `json:"ttl"` //seconds
+	ExpiresAt *time.Time  `json:"expiresAt,omitempty"`
+	Payload   interface{} `json:"payload,omitempty"`
+}
+
+// NewAdminHandler creates the management API handler, the data storage must implement ftp.WritableDataStorage.
+// It panics if the token isn't set and opts.Insecure isn't set either
+func NewAdminHandler(ds ftp.DataStorage, ts ftp.TemplateStorage, uidGenerator uidgenerator.UID, opts *AdminOpts, logger *log.Logger) *AdminHandler {
+	ws, ok := ds.(ftp.WritableDataStorage)
+	if !ok {
+		panic("DataStorage isn't writable")
+	}
+	if ts == nil {
+		panic("TemplateStorage isn't defined")
+	}
+	if uidGenerator == nil {
+		panic("Uid generator isn't defined")
+	}
+	if opts == nil {
+		opts = &AdminOpts{}
+	}
+	if opts.Token == "" && !opts.Insecure {
+		panic("Admin API token isn't defined, set Insecure to serve the API without it")
+	}
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	o := *opts
+	if o.LinkExt == "" {
+		o.LinkExt = "html"
+	}
+	return &AdminHandler{ws, ts, uidGenerator, o, logger}
+}
+
+// ServeHTTP implements http.Handler
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.opts.Token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.opts.Token)) != 1 {
+			h.error(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+	}
+
+	p := strings.Trim(path.Clean("/"+r.URL.Path), "/")
+	if p == "records" {
+		switch r.Method {
+		case http.MethodGet:
+			h.list(w, r)
+		case http.MethodPost:
+			h.create(w, r)
+		default:
+			h.error(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+
+	if !strings.HasPrefix(p, "records/") || strings.Contains(p[len("records/"):], "/") {
+		h.error(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	uid, err := h.uidGenerator.Validate(p[len("records/"):])
+	if err != nil {
+		h.error(w, http.StatusNotFound, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.read(w, r, uid)
+	case http.MethodPut:
+		h.update(w, r, uid)
+	case http.MethodDelete:
+		h.delete(w, r, uid)
+	default:
+		h.error(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (h *AdminHandler) list(w http.ResponseWriter, r *http.Request) {
+	dl, ok := h.ds.(ftp.DataLister)
+	if !ok {
+		h.error(w, http.StatusNotImplemented, ftp.ERR_NOT_SUPPORTED)
+		return
+	}
+	keys, err := dl.Keys()
+	if err != nil {
+		h.error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	records := make([]*adminRecord, 0, len(keys))
+	for _, uid := range keys {
+		_, createdAt, ttl, err := h.ds.Get(uid)
+		if err != nil {
+			continue
+		}
+		records = append(records, h.record(uid, "", nil, createdAt, ttl))
+	}
+	h.reply(w, http.StatusOK, records)
+}
+
+func (h *AdminHandler) create(w http.ResponseWriter, r *http.Request) {
+	req, ttl, err := h.decode(r)
+	if err != nil {
+		h.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	uid := h.uidGenerator.New()
+	if err := h.ds.Put(uid, req.Payload, ttl); err != nil {
+		h.error(w, http.StatusInternalServerError, err)
+		return
+	}
+	h.logger.Printf("%sADMIN created %s", ftp.LOG_PREFIX, uid)
+	h.replyRecord(w, http.StatusCreated, uid, req.Template)
+}
+
+func (h *AdminHandler) read(w http.ResponseWriter, r *http.Request, uid string) {
+	h.replyRecord(w, http.StatusOK, uid, r.URL.Query().Get("template"))
+}
+
+func (h *AdminHandler) update(w http.ResponseWriter, r *http.Request, uid string) {
+	if _, _, _, err := h.ds.Get(uid); err != nil {
+		h.error(w, http.StatusNotFound, err)
+		return
+	}
+	req, ttl, err := h.decode(r)
+	if err != nil {
+		h.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.ds.Put(uid, req.Payload, ttl); err != nil {
+		h.error(w, http.StatusInternalServerError, err)
+		return
+	}
+	h.logger.Printf("%sADMIN updated %s", ftp.LOG_PREFIX, uid)
+	h.replyRecord(w, http.StatusOK, uid, req.Template)
+}
+
+func (h *AdminHandler) delete(w http.ResponseWriter, r *http.Request, uid string) {
+	ds, ok := h.ds.(ftp.DeletableDataStorage)
+	if !ok {
+		h.error(w, http.StatusNotImplemented, ftp.ERR_NOT_SUPPORTED)
+		return
+	}
+	if _, _, _, err := h.ds.Get(uid); err != nil {
+		h.error(w, http.StatusNotFound, err)
+		return
+	}
+	if err := ds.Delete(uid); err != nil {
+		h.error(w, http.StatusInternalServerError, err)
+		return
+	}
+	h.logger.Printf("%sADMIN deleted %s", ftp.LOG_PREFIX, uid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//decode parses the request body and validates the template
+func (h *AdminHandler) decode(r *http.Request) (*adminRequest, *time.Duration, error) {
+	req := &adminRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, nil, err
+	}
+
+	req.Template = strings.Trim(req.Template, "/")
+	if req.Template != "" {
+		if _, err := h.ts.Template(req.Template); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ttl, err := parseTTL(req.TTL)
+	return req, ttl, err
+}
+
+//parseTTL parses the ttl given as a duration string or a number of seconds, it returns nil if ttl isn't set
+func parseTTL(raw json.RawMessage) (*time.Duration, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var ttl time.Duration
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if ttl, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("%v: %s", ErrAdminBadTTL, s)
+		}
+	} else {
+		var seconds float64
+		if err := json.Unmarshal(raw, &seconds); err != nil {
+			return nil, fmt.Errorf("%v: %s", ErrAdminBadTTL, raw)
+		}
+		ttl = time.Duration(seconds * float64(time.Second))
+	}
+
+	if ttl <= 0 {
+		return nil, fmt.Errorf("%v: %s", ErrAdminBadTTL, raw)
+	}
+	return &ttl, nil
+}
+
+func (h *AdminHandler) replyRecord(w http.ResponseWriter, status int, uid string, template string) {
+	payload, createdAt, ttl, err := h.ds.Get(uid)
+	if err != nil {
+		h.error(w, http.StatusNotFound, err)
+		return
+	}
+	h.reply(w, status, h.record(uid, template, payload, createdAt, ttl))
+}
+
+func (h *AdminHandler) record(uid string, template string, payload interface{}, createdAt time.Time, ttl time.Duration) *adminRecord {
+	rec := &adminRecord{
+		Uid:       uid,
+		Template:  template,
+		CreatedAt: createdAt,
+		TTL:       int64(ttl / time.Second),
+		Payload:   payload,
+	}
+	if ttl > 0 {
+		expiresAt := createdAt.Add(ttl)
+		rec.ExpiresAt = &expiresAt
+	}
+	if h.opts.LinkHost != "" {
+		rec.Link = "ftp://" + h.opts.LinkHost + path.Join("/", template, uid+"."+h.opts.LinkExt)
+	}
+	return rec
+}
+
+func (h *AdminHandler) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.Printf("%sWARN ADMIN %v", ftp.LOG_PREFIX, err)
+	}
+}
+
+func (h *AdminHandler) error(w http.ResponseWriter, status int, err error) {
+	h.reply(w, status, map[string]string{"error": err.Error()})
+}
+
+// AdminHandler returns the management API handler working with the server's storages.
+// If opts.LinkHost is empty, the links are built with the server's public ip (or hostname) and port,
+// it panics if neither is set or the server listens on all the addresses, the links can't be built then
+func (ftpdt *Ftpdt) AdminHandler(opts *AdminOpts) http.Handler {
+	o := AdminOpts{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.LinkHost == "" {
+		host := ftpdt.PublicIP
+		if host == "" {
+			host = ftpdt.Hostname
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			panic("Admin API links can't be built, set AdminOpts.LinkHost or FtpOpts.PublicIP")
+		}
+		if ftpdt.Port != 21 {
+			host = net.JoinHostPort(host, strconv.Itoa(ftpdt.Port))
+		}
+		o.LinkHost = host
+	}
+	return NewAdminHandler(ftpdt.opts.DataStorage, ftpdt.opts.TemplateStorage, ftpdt.opts.UidGenerator, &o, ftpdt.log)
+}
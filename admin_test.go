@@ -0,0 +1,117 @@
+package ftpdt
+
+import (
+	"encoding/json"
+	"github.com/starshiptroopers/ftpdt/datastorage"
+	"github.com/starshiptroopers/ftpdt/goftp/core"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminCall(t *testing.T, h http.Handler, method string, url string, body string, token string) (int, map[string]interface{}) {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	var reply map[string]interface{}
+	if w.Body.Len() > 0 && w.Body.Bytes()[0] == '{' {
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("%s %s: wrong reply %s: %v", method, url, w.Body.String(), err)
+		}
+	}
+	return w.Code, reply
+}
+
+func TestAdminHandler(t *testing.T) {
+	ftpd := New(&Opts{
+		FtpOpts:         &core.ServerOpts{Port: 2121, Hostname: "example.com"},
+		TemplateStorage: NewDummyTemplateStorage(),
+		DataStorage:     datastorage.NewMemoryDataStorage(),
+		UidGenerator:    newUidGenerator(),
+	})
+	h := ftpd.AdminHandler(&AdminOpts{Token: "secret"})
+
+	if code, _ := adminCall(t, h, "GET", "/records", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Unauthorized request must be rejected, got %d", code)
+	}
+
+	code, rec := adminCall(t, h, "POST", "/records", `{"template": "", "ttl": "1h", "payload": {"Title": "T"}}`, "secret")
+	if code != http.StatusCreated {
+		t.Fatalf("Create returns %d: %v", code, rec)
+	}
+	uid, _ := rec["uid"].(string)
+	if rec["link"] != "ftp://example.com:2121/"+uid+".html" || rec["ttl"] != float64(3600) {
+		t.Errorf("Wrong created record: %v", rec)
+	}
+
+	if code, _ := adminCall(t, h, "POST", "/records", `{"template": "unknown", "payload": {}}`, "secret"); code != http.StatusBadRequest {
+		t.Errorf("Unknown template must be rejected, got %d", code)
+	}
+
+	code, rec = adminCall(t, h, "PUT", "/records/"+uid, `{"ttl": 60, "payload": {"Title": "Updated"}}`, "secret")
+	if code != http.StatusOK || rec["ttl"] != float64(60) {
+		t.Errorf("Update returns %d: %v", code, rec)
+	}
+
+	code, rec = adminCall(t, h, "GET", "/records/"+uid, "", "secret")
+	if p, _ := rec["payload"].(map[string]interface{}); code != http.StatusOK || p["Title"] != "Updated" {
+		t.Errorf("Read returns %d: %v", code, rec)
+	}
+
+	r := httptest.NewRequest("GET", "/records", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var list []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0]["uid"] != uid {
+		t.Errorf("Wrong records list: %s", w.Body.String())
+	}
+
+	if code, _ := adminCall(t, h, "DELETE", "/records/"+uid, "", "secret"); code != http.StatusNoContent {
+		t.Errorf("Delete returns %d", code)
+	}
+	if code, _ := adminCall(t, h, "GET", "/records/"+uid, "", "secret"); code != http.StatusNotFound {
+		t.Errorf("Deleted record is still returned, %d", code)
+	}
+}
+
+// The API isn't served without the token unless it's insecure, the links aren't built from the unspecified address
+func TestAdminHandlerOpts(t *testing.T) {
+	newServer := func(opts *core.ServerOpts) *Ftpdt {
+		return New(&Opts{
+			FtpOpts:         opts,
+			TemplateStorage: NewDummyTemplateStorage(),
+			DataStorage:     datastorage.NewMemoryDataStorage(),
+			UidGenerator:    newUidGenerator(),
+		})
+	}
+	panics := func(f func()) (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		f()
+		return
+	}
+
+	ftpd := newServer(&core.ServerOpts{Hostname: "example.com"})
+	if !panics(func() { ftpd.AdminHandler(nil) }) {
+		t.Error("Admin API is served without the token")
+	}
+	h := ftpd.AdminHandler(&AdminOpts{Insecure: true})
+	if code, _ := adminCall(t, h, "GET", "/records", "", ""); code != http.StatusOK {
+		t.Errorf("Insecure API rejects the request, got %d", code)
+	}
+
+	ftpd = newServer(&core.ServerOpts{Port: 2121})
+	if !panics(func() { ftpd.AdminHandler(&AdminOpts{Token: "secret"}) }) {
+		t.Error("Links are built from the unspecified address")
+	}
+	h = ftpd.AdminHandler(&AdminOpts{Token: "secret", LinkHost: "ftp.example.com"})
+	code, rec := adminCall(t, h, "POST", "/records", `{"payload": {"Title": "T"}}`, "secret")
+	if uid, _ := rec["uid"].(string); code != http.StatusCreated || rec["link"] != "ftp://ftp.example.com/"+uid+".html" {
+		t.Errorf("Wrong created record %d: %v", code, rec)
+	}
+}
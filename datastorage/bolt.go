@@ -0,0 +1,169 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package datastorage
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"sync"
+	"time"
+)
+
+var boltBucket = []byte("records")
+
+// BoltDataStorage is a persistent data storage keeping the records in the bbolt database file.
+// Expired records aren't returned and are removed in the background every DefaultCacheGCInterval seconds
+type BoltDataStorage struct {
+	db              *bolt.DB
+	codec           Codec
+	DefaultCacheTTL time.Duration
+	stop            chan struct{}
+	wg              sync.WaitGroup
+}
+
+// NewBoltDataStorage opens (or creates) the database file at path, payloads are encoded with codec (JSONCodec if nil)
+func NewBoltDataStorage(path string, codec Codec) (*BoltDataStorage, error) {
+	db, err := bolt.Open(path, os.FileMode(0600), &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	s := &BoltDataStorage{
+		db:              db,
+		codec:           codec,
+		DefaultCacheTTL: DefaultCacheTTL,
+		stop:            make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.gc(time.Second * time.Duration(DefaultCacheGCInterval))
+	return s, nil
+}
+
+func (t *BoltDataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
+	var b []byte
+	err = t.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltBucket).Get([]byte(uid)); v != nil {
+			b = append(b, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if b == nil {
+		err = ErrNFound
+		return
+	}
+
+	payload, createdAt, ttl, err = decodeRecord(t.codec, b)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	if expired(createdAt, ttl, time.Now()) {
+		return nil, time.Time{}, 0, ErrNFound
+	}
+	return
+}
+
+func (t *BoltDataStorage) Put(uid string, payload interface{}, ttl *time.Duration) error {
+	if ttl == nil {
+		ttl = &t.DefaultCacheTTL
+	}
+
+	b, err := encodeRecord(t.codec, time.Now(), *ttl, payload)
+	if err != nil {
+		return err
+	}
+
+	return t.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(uid), b)
+	})
+}
+
+// Delete removes the record, it implements ftp.DeletableDataStorage
+func (t *BoltDataStorage) Delete(uid string) error {
+	return t.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket.Get([]byte(uid)) == nil {
+			return ErrNFound
+		}
+		return bucket.Delete([]byte(uid))
+	})
+}
+
+// Keys returns uids of all alive records, it implements ftp.DataLister
+func (t *BoltDataStorage) Keys() ([]string, error) {
+	now := time.Now()
+	var keys []string
+	err := t.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			created, ttl, err := decodeRecordHeader(v)
+			if err == nil && !expired(created, ttl, now) {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// Close stops the background expiration and closes the database
+func (t *BoltDataStorage) Close() error {
+	close(t.stop)
+	t.wg.Wait()
+	return t.db.Close()
+}
+
+// gc removes the expired records every interval
+func (t *BoltDataStorage) gc(interval time.Duration) {
+	defer t.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			_ = t.expire()
+		}
+	}
+}
+
+// expire removes the expired records
+func (t *BoltDataStorage) expire() error {
+	now := time.Now()
+	return t.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			created, ttl, err := decodeRecordHeader(v)
+			if err != nil || expired(created, ttl, now) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,65 @@
+package datastorage
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltDataStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("Can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "data.db")
+	s, err := NewBoltDataStorage(path, nil)
+	if err != nil {
+		t.Fatalf("Can't open the storage: %v", err)
+	}
+	testDataStorage(t, s, time.Sleep)
+
+	_ = s.Put("PERSISTENT", map[string]interface{}{"body": "somebody"}, nil)
+	if err := s.expire(); err != nil {
+		t.Errorf("Expiration error: %v", err)
+	}
+	_ = s.Close()
+
+	//records survive the restart
+	s, err = NewBoltDataStorage(path, nil)
+	if err != nil {
+		t.Fatalf("Can't reopen the storage: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	if keys, _ := s.Keys(); len(keys) != 1 || keys[0] != "PERSISTENT" {
+		t.Errorf("Wrong keys after reopening: %v", keys)
+	}
+	if _, _, _, err := s.Get("PERSISTENT"); err != nil {
+		t.Errorf("Stored element is lost after reopening: %v", err)
+	}
+}
+
+func TestGobCodec(t *testing.T) {
+	type record struct {
+		Body string
+	}
+	codec := GobCodec{}
+	gob.Register(record{})
+
+	b, err := codec.Marshal(record{"somebody"})
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+	p, err := codec.Unmarshal(b)
+	if err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if r, ok := p.(record); !ok || r.Body != "somebody" {
+		t.Errorf("Wrong decoded payload %#v", p)
+	}
+}
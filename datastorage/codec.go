@@ -0,0 +1,94 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package datastorage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrBadRecord = errors.New("malformed data record")
+)
+
+// Codec encodes the records payloads for the persistent storages
+type Codec interface {
+	Marshal(payload interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// JSONCodec encodes payloads as JSON, objects are decoded to map[string]interface{}
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(payload interface{}) ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (JSONCodec) Unmarshal(data []byte) (interface{}, error) {
+	var payload interface{}
+	err := json.Unmarshal(data, &payload)
+	return payload, err
+}
+
+// GobCodec encodes payloads with encoding/gob, it keeps the payload types,
+// but every concrete payload type must be registered with gob.Register
+type GobCodec struct{}
+
+type gobRecord struct {
+	Payload interface{}
+}
+
+func (GobCodec) Marshal(payload interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(&gobRecord{payload})
+	return b.Bytes(), err
+}
+
+func (GobCodec) Unmarshal(data []byte) (interface{}, error) {
+	r := gobRecord{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&r)
+	return r.Payload, err
+}
+
+// encodeRecord packs the record as: created (unix nano, 8 bytes) | ttl (nanoseconds, 8 bytes) | payload
+func encodeRecord(codec Codec, created time.Time, ttl time.Duration, payload interface{}) ([]byte, error) {
+	data, err := codec.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint64(b[0:8], uint64(created.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:16], uint64(ttl))
+	copy(b[16:], data)
+	return b, nil
+}
+
+// decodeRecordHeader returns the record's creation time and ttl
+func decodeRecordHeader(b []byte) (created time.Time, ttl time.Duration, err error) {
+	if len(b) < 16 {
+		return time.Time{}, 0, ErrBadRecord
+	}
+	created = time.Unix(0, int64(binary.BigEndian.Uint64(b[0:8])))
+	ttl = time.Duration(binary.BigEndian.Uint64(b[8:16]))
+	return created, ttl, nil
+}
+
+// decodeRecord unpacks the record packed with encodeRecord
+func decodeRecord(codec Codec, b []byte) (payload interface{}, created time.Time, ttl time.Duration, err error) {
+	if created, ttl, err = decodeRecordHeader(b); err != nil {
+		return
+	}
+	payload, err = codec.Unmarshal(b[16:])
+	return
+}
+
+// expired reports whether the record created at created with ttl is expired, zero ttl never expires
+func expired(created time.Time, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.After(created.Add(ttl))
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package datastorage
+
+import (
+	"context"
+	"errors"
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/sync/singleflight"
+	"time"
+)
+
+var (
+	DefaultLoaderCacheSize = 1024
+	DefaultNegativeTTL     = time.Minute
+)
+
+// Loader fetches the record's payload and ttl from a backend, it must return ErrNFound (or an error wrapping it)
+// if there is no such record or it has expired. The ttl is the time the record has left to live, it's counted from the load
+type Loader func(ctx context.Context, uid string) (payload interface{}, ttl time.Duration, err error)
+
+// LoaderDataStorage invokes the records with a Loader callback instead of storing them in advance.
+// Loaded records are kept in the bounded LRU cache, misses are cached for NegativeTTL,
+// concurrent requests for the same uid trigger the only one Loader call.
+// The record's creation time is the time it has been loaded, so it's reset on every reload and the record doesn't expire
+// by itself: the Loader must count the ttl down and report the expired records as missing
+type LoaderDataStorage struct {
+	loader      Loader
+	cache       *lru.Cache
+	group       singleflight.Group
+	CacheTTL    time.Duration //max time a loaded record is cached, a record's ttl is used if it's shorter
+	NegativeTTL time.Duration //time a miss is cached, misses aren't cached if 0
+	LoadTimeout time.Duration //timeout of the Loader call, no timeout if 0
+}
+
+type loadedRecord struct {
+	payload     interface{}
+	created     time.Time
+	ttl         time.Duration
+	cachedUntil time.Time
+	err         error
+}
+
+// NewLoaderDataStorage creates the storage which caches up to size records (DefaultLoaderCacheSize if 0)
+func NewLoaderDataStorage(loader Loader, size int) *LoaderDataStorage {
+	if loader == nil {
+		panic("loader isn't defined")
+	}
+	if size <= 0 {
+		size = DefaultLoaderCacheSize
+	}
+	c, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return &LoaderDataStorage{
+		loader:      loader,
+		cache:       c,
+		CacheTTL:    DefaultCacheTTL,
+		NegativeTTL: DefaultNegativeTTL,
+	}
+}
+
+func (t *LoaderDataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
+	if v, ok := t.cache.Get(uid); ok {
+		r := v.(*loadedRecord)
+		if time.Now().Before(r.cachedUntil) {
+			return r.payload, r.created, r.ttl, r.err
+		}
+		t.cache.Remove(uid)
+	}
+
+	v, err, _ := t.group.Do(uid, func() (interface{}, error) {
+		return t.load(uid)
+	})
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	r := v.(*loadedRecord)
+	return r.payload, r.created, r.ttl, r.err
+}
+
+//load calls the loader and caches the result
+func (t *LoaderDataStorage) load(uid string) (*loadedRecord, error) {
+	ctx := context.Background()
+	if t.LoadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.LoadTimeout)
+		defer cancel()
+	}
+
+	now := time.Now()
+	payload, ttl, err := t.loader(ctx, uid)
+	if errors.Is(err, ErrNFound) {
+		r := &loadedRecord{err: ErrNFound, cachedUntil: now.Add(t.NegativeTTL)}
+		if t.NegativeTTL > 0 {
+			t.cache.Add(uid, r)
+		}
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cacheTTL := t.CacheTTL
+	if ttl > 0 && ttl < cacheTTL {
+		cacheTTL = ttl
+	}
+	r := &loadedRecord{payload: payload, created: now, ttl: ttl, cachedUntil: now.Add(cacheTTL)}
+	t.cache.Add(uid, r)
+	return r, nil
+}
@@ -0,0 +1,79 @@
+package datastorage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoaderDataStorage(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context, uid string) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		if uid == "MISSING" {
+			return nil, 0, ErrNFound
+		}
+		if uid == "WRAPPED" {
+			return nil, 0, fmt.Errorf("backend: %w", ErrNFound)
+		}
+		return "payload " + uid, time.Hour, nil
+	}
+	s := NewLoaderDataStorage(loader, 2)
+
+	//concurrent requests trigger only one backend lookup
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p, _, ttl, err := s.Get("ELEMENT1"); err != nil || p != "payload ELEMENT1" || ttl != time.Hour {
+				t.Errorf("Wrong loaded record %v, %v, %v", p, ttl, err)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Loader is called %d times for concurrent requests", calls)
+	}
+
+	//cached
+	_, _, _, _ = s.Get("ELEMENT1")
+	if calls != 1 {
+		t.Error("Loaded record isn't cached")
+	}
+
+	//negative caching
+	for i := 0; i < 2; i++ {
+		if _, _, _, err := s.Get("MISSING"); err != ErrNFound {
+			t.Errorf("ErrNFound is expected, got %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Miss isn't cached, loader is called %d times", calls)
+	}
+
+	//the wrapped ErrNFound is a miss too
+	for i := 0; i < 2; i++ {
+		if _, _, _, err := s.Get("WRAPPED"); err != ErrNFound {
+			t.Errorf("ErrNFound is expected, got %v", err)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("Wrapped miss isn't cached, loader is called %d times", calls)
+	}
+
+	//the cache is bounded, ELEMENT1 is evicted
+	_, _, _, _ = s.Get("ELEMENT2")
+	_, _, _, _ = s.Get("ELEMENT1")
+	if calls != 5 {
+		t.Errorf("Least recently used record isn't evicted, loader is called %d times", calls)
+	}
+}
@@ -8,6 +8,8 @@ package datastorage
 import (
 	"errors"
 	"github.com/astaxie/beego/cache"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -19,6 +21,8 @@ var (
 
 type MemoryDataStorage struct {
 	cache                  cache.Cache
+	keys                   map[string]time.Time //keys index with expiration time, beego cache can't enumerate its items
+	keysMu                 sync.Mutex
 	DefaultCacheGCInterval uint //seconds
 	DefaultCacheTTL        time.Duration
 }
@@ -30,12 +34,13 @@ type dataRecord struct {
 }
 
 func NewMemoryDataStorage() *MemoryDataStorage {
-	c, err := cache.NewCache("memory", `{"interval":`+string(DefaultCacheGCInterval)+"}")
+	c, err := cache.NewCache("memory", `{"interval":`+strconv.Itoa(DefaultCacheGCInterval)+"}")
 	if err != nil {
 		panic(err)
 	}
 	return &MemoryDataStorage{
 		cache:           c,
+		keys:            make(map[string]time.Time),
 		DefaultCacheTTL: DefaultCacheTTL,
 	}
 }
@@ -57,9 +62,51 @@ func (t *MemoryDataStorage) Put(uid string, payload interface{}, ttl *time.Durat
 		ttl = &t.DefaultCacheTTL
 	}
 
-	return t.cache.Put(uid, &dataRecord{
-		created: time.Now(),
+	created := time.Now()
+	if err := t.cache.Put(uid, &dataRecord{
+		created: created,
 		ttl:     *ttl,
 		payload: payload,
-	}, *ttl)
+	}, *ttl); err != nil {
+		return err
+	}
+
+	//zero ttl means the record never expires
+	var expired time.Time
+	if *ttl > 0 {
+		expired = created.Add(*ttl)
+	}
+	t.keysMu.Lock()
+	t.keys[uid] = expired
+	t.keysMu.Unlock()
+	return nil
+}
+
+// Keys returns uids of all alive records, it implements ftp.DataLister
+func (t *MemoryDataStorage) Keys() ([]string, error) {
+	now := time.Now()
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+
+	keys := make([]string, 0, len(t.keys))
+	for uid, expired := range t.keys {
+		if (!expired.IsZero() && now.After(expired)) || !t.cache.IsExist(uid) {
+			delete(t.keys, uid)
+			continue
+		}
+		keys = append(keys, uid)
+	}
+	return keys, nil
+}
+
+// Delete removes the record, it implements ftp.DeletableDataStorage
+func (t *MemoryDataStorage) Delete(uid string) error {
+	t.keysMu.Lock()
+	delete(t.keys, uid)
+	t.keysMu.Unlock()
+
+	if !t.cache.IsExist(uid) {
+		return ErrNFound
+	}
+	return t.cache.Delete(uid)
 }
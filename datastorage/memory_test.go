@@ -59,3 +59,7 @@ func TestMemoryDataStorage(t *testing.T) {
 		}
 	}
 }
+
+func TestMemoryDataStorageSuite(t *testing.T) {
+	testDataStorage(t, NewMemoryDataStorage(), time.Sleep)
+}
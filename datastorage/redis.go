@@ -0,0 +1,135 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package datastorage
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// DefaultRedisPrefix is prepended to the uids to get the redis keys
+var DefaultRedisPrefix = "ftpdt:"
+
+// RedisDataStorage keeps the records in a redis server, so several ftpdt instances can share them.
+// The record's ttl is mapped to the key expiration, the creation time and ttl are stored along with the payload
+type RedisDataStorage struct {
+	pool            *redis.Pool
+	codec           Codec
+	prefix          string
+	DefaultCacheTTL time.Duration
+}
+
+// NewRedisDataStorage creates the storage working through the redis connection pool,
+// keys are prefixed with DefaultRedisPrefix, payloads are encoded with codec (JSONCodec if nil)
+func NewRedisDataStorage(pool *redis.Pool, codec Codec) *RedisDataStorage {
+	if pool == nil {
+		panic("redis pool isn't defined")
+	}
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &RedisDataStorage{
+		pool:            pool,
+		codec:           codec,
+		prefix:          DefaultRedisPrefix,
+		DefaultCacheTTL: DefaultCacheTTL,
+	}
+}
+
+// NewRedisPool creates a redis connection pool for the server at addr ("host:port")
+func NewRedisPool(addr string, options ...redis.DialOption) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: time.Minute * 5,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, options...)
+		},
+	}
+}
+
+func (t *RedisDataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
+	c := t.pool.Get()
+	defer func() { _ = c.Close() }()
+
+	b, err := redis.Bytes(c.Do("GET", t.prefix+uid))
+	if err == redis.ErrNil {
+		err = ErrNFound
+		return
+	} else if err != nil {
+		return
+	}
+
+	payload, createdAt, ttl, err = decodeRecord(t.codec, b)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	if expired(createdAt, ttl, time.Now()) {
+		return nil, time.Time{}, 0, ErrNFound
+	}
+	return
+}
+
+func (t *RedisDataStorage) Put(uid string, payload interface{}, ttl *time.Duration) error {
+	if ttl == nil {
+		ttl = &t.DefaultCacheTTL
+	}
+
+	b, err := encodeRecord(t.codec, time.Now(), *ttl, payload)
+	if err != nil {
+		return err
+	}
+
+	c := t.pool.Get()
+	defer func() { _ = c.Close() }()
+
+	if *ttl > 0 {
+		//PX is in milliseconds, the ttl is rounded up, so a sub-millisecond one doesn't become 0 which redis refuses
+		px := int64((*ttl + time.Millisecond - 1) / time.Millisecond)
+		_, err = c.Do("SET", t.prefix+uid, b, "PX", px)
+	} else {
+		_, err = c.Do("SET", t.prefix+uid, b)
+	}
+	return err
+}
+
+// Delete removes the record, it implements ftp.DeletableDataStorage
+func (t *RedisDataStorage) Delete(uid string) error {
+	c := t.pool.Get()
+	defer func() { _ = c.Close() }()
+
+	n, err := redis.Int64(c.Do("DEL", t.prefix+uid))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNFound
+	}
+	return nil
+}
+
+// Keys returns uids of all alive records, it implements ftp.DataLister
+func (t *RedisDataStorage) Keys() ([]string, error) {
+	c := t.pool.Get()
+	defer func() { _ = c.Close() }()
+
+	var keys []string
+	cursor := int64(0)
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", t.prefix+"*", "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		var found []string
+		if _, err = redis.Scan(values, &cursor, &found); err != nil {
+			return nil, err
+		}
+		for _, k := range found {
+			keys = append(keys, k[len(t.prefix):])
+		}
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package datastorage
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"testing"
+	"time"
+)
+
+func TestRedisDataStorage(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Can't start the redis server: %v", err)
+	}
+	defer mr.Close()
+
+	pool := NewRedisPool(mr.Addr())
+	defer func() { _ = pool.Close() }()
+
+	testDataStorage(t, NewRedisDataStorage(pool, nil), func(d time.Duration) {
+		time.Sleep(d)
+		mr.FastForward(d)
+	})
+
+	//the records are shared between the instances
+	s1, s2 := NewRedisDataStorage(pool, nil), NewRedisDataStorage(NewRedisPool(mr.Addr()), nil)
+	_ = s1.Put("SHARED", map[string]interface{}{"body": "somebody"}, nil)
+	if _, _, ttl, err := s2.Get("SHARED"); err != nil || ttl != DefaultCacheTTL {
+		t.Errorf("A record isn't shared between the instances: %v", err)
+	}
+	if d := mr.TTL(DefaultRedisPrefix + "SHARED"); d != DefaultCacheTTL {
+		t.Errorf("Redis key expiration %v doesn't match the record's ttl", d)
+	}
+
+	//a sub-millisecond ttl is rounded up
+	short := time.Microsecond * 500
+	if err := s1.Put("SHORT", map[string]interface{}{"body": "somebody"}, &short); err != nil {
+		t.Errorf("A record with the sub-millisecond ttl isn't stored: %v", err)
+	}
+	if d := mr.TTL(DefaultRedisPrefix + "SHORT"); d != time.Millisecond {
+		t.Errorf("Redis key expiration %v isn't rounded up", d)
+	}
+}
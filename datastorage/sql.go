@@ -0,0 +1,77 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package datastorage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SQLColumns maps the record fields to the table columns
+type SQLColumns struct {
+	Uid       string //record uid
+	Payload   string //JSON encoded payload
+	CreatedAt string //record creation timestamp
+	TTL       string //record ttl in seconds, 0 or NULL means the record never expires
+}
+
+// DefaultSQLColumns is used if the columns mapping isn't defined
+var DefaultSQLColumns = SQLColumns{
+	Uid:       "uid",
+	Payload:   "payload",
+	CreatedAt: "created_at",
+	TTL:       "ttl",
+}
+
+// SQLDataStorage is a read only data storage invoking the records from a sql database table.
+// The records are expired according to the created_at and ttl columns.
+// The query uses $1 placeholder, which is supported by PostgreSQL and SQLite.
+// No database driver is imported by the library, the application imports the one it uses
+type SQLDataStorage struct {
+	db    *sql.DB
+	query string
+}
+
+// NewSQLDataStorage creates the storage reading the records from the table, DefaultSQLColumns are used if columns is nil
+func NewSQLDataStorage(db *sql.DB, table string, columns *SQLColumns) *SQLDataStorage {
+	if db == nil {
+		panic("database isn't defined")
+	}
+	if columns == nil {
+		columns = &DefaultSQLColumns
+	}
+	return &SQLDataStorage{
+		db: db,
+		query: fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE %s = $1",
+			columns.Payload, columns.CreatedAt, columns.TTL, table, columns.Uid),
+	}
+}
+
+// Get returns the record's payload decoded to map[string]interface{}
+func (t *SQLDataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
+	var data []byte
+	var seconds sql.NullInt64
+
+	err = t.db.QueryRow(t.query, uid).Scan(&data, &createdAt, &seconds)
+	if err == sql.ErrNoRows {
+		err = ErrNFound
+		return
+	} else if err != nil {
+		return
+	}
+
+	ttl = time.Duration(seconds.Int64) * time.Second
+	if expired(createdAt, ttl, time.Now()) {
+		return nil, time.Time{}, 0, ErrNFound
+	}
+
+	m := map[string]interface{}{}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	return m, createdAt, ttl, nil
+}
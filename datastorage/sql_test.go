@@ -0,0 +1,55 @@
+package datastorage
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+	"time"
+)
+
+func TestSQLDataStorage(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Can't open the database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE links (id TEXT PRIMARY KEY, data TEXT, created TIMESTAMP, lifetime INTEGER)`)
+	if err != nil {
+		t.Fatalf("Can't create the table: %v", err)
+	}
+
+	now := time.Now()
+	_, err = db.Exec(`INSERT INTO links VALUES ($1, $2, $3, $4), ($5, $6, $7, $8), ($9, $10, $11, NULL)`,
+		"ALIVE", `{"Url": "https://starshiptroopers.dev"}`, now, 3600,
+		"EXPIRED", `{"Url": "https://starshiptroopers.dev"}`, now.Add(-time.Hour*2), 3600,
+		"FOREVER", `{"Url": "https://starshiptroopers.dev"}`, now.Add(-time.Hour*24*365),
+	)
+	if err != nil {
+		t.Fatalf("Can't insert the records: %v", err)
+	}
+
+	s := NewSQLDataStorage(db, "links", &SQLColumns{Uid: "id", Payload: "data", CreatedAt: "created", TTL: "lifetime"})
+
+	p, c, ttl, err := s.Get("ALIVE")
+	if err != nil {
+		t.Fatalf("A stored record isn't found: %v", err)
+	}
+	if m, ok := p.(map[string]interface{}); !ok || m["Url"] != "https://starshiptroopers.dev" {
+		t.Errorf("Wrong payload %#v", p)
+	}
+	if ttl != time.Hour || !c.Equal(now) {
+		t.Errorf("Wrong creation time %v or ttl %v", c, ttl)
+	}
+
+	if _, _, _, err := s.Get("EXPIRED"); err != ErrNFound {
+		t.Errorf("ErrNFound is expected for expired record, got %v", err)
+	}
+	if _, _, _, err := s.Get("FOREVER"); err != nil {
+		t.Errorf("A record without ttl must not expire: %v", err)
+	}
+	if _, _, _, err := s.Get("UNKNOWN"); err != ErrNFound {
+		t.Errorf("ErrNFound is expected for non-existing record, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package datastorage
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testedStorage is a data storage checked with the common test suite
+type testedStorage interface {
+	Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error)
+	Put(uid string, payload interface{}, ttl *time.Duration) error
+	Delete(uid string) error
+	Keys() ([]string, error)
+}
+
+// testDataStorage is the test suite every data storage implementation has to pass,
+// wait is used to let the records expire
+func testDataStorage(t *testing.T, s testedStorage, wait func(time.Duration)) {
+	if _, _, _, e := s.Get("something"); e != ErrNFound {
+		t.Errorf("ErrNFound is expected for non-existing element, got %v", e)
+	}
+
+	payload := map[string]interface{}{"body": "somebody"}
+	if e := s.Put("ELEMENT1", payload, nil); e != nil {
+		t.Fatalf("Error on Put: %v", e)
+	}
+
+	p, c, ttl, e := s.Get("ELEMENT1")
+	if e != nil {
+		t.Fatalf("A Stored element not found: %v", e)
+	}
+	if dt := time.Since(c); dt < 0 || dt > time.Second {
+		t.Error("Creation timestamp is wrong")
+	}
+	if ttl != DefaultCacheTTL {
+		t.Errorf("Default ttl is expected, got %v", ttl)
+	}
+	if !reflect.DeepEqual(p, payload) {
+		t.Errorf("Get returns wrong data: %v", p)
+	}
+
+	short := time.Millisecond * 50
+	if e := s.Put("ELEMENT2", payload, &short); e != nil {
+		t.Fatalf("Error on Put: %v", e)
+	}
+	if _, _, ttl, _ := s.Get("ELEMENT2"); ttl != short {
+		t.Errorf("Wrong ttl %v", ttl)
+	}
+
+	keys, e := s.Keys()
+	sort.Strings(keys)
+	if e != nil || !reflect.DeepEqual(keys, []string{"ELEMENT1", "ELEMENT2"}) {
+		t.Errorf("Wrong keys %v, %v", keys, e)
+	}
+
+	wait(short * 2)
+
+	if _, _, _, e := s.Get("ELEMENT2"); e != ErrNFound {
+		t.Errorf("Expired element must not be returned, got %v", e)
+	}
+	if keys, _ := s.Keys(); len(keys) != 1 || keys[0] != "ELEMENT1" {
+		t.Errorf("Expired keys must not be returned, got %v", keys)
+	}
+
+	if e := s.Delete("ELEMENT1"); e != nil {
+		t.Errorf("Delete returns error: %v", e)
+	}
+	if _, _, _, e := s.Get("ELEMENT1"); e != ErrNFound {
+		t.Error("Deleted element is still returned")
+	}
+	if e := s.Delete("ELEMENT1"); e != ErrNFound {
+		t.Errorf("ErrNFound is expected for non-existing element, got %v", e)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package datastorage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadToken = errors.New("token is malformed or its signature is wrong")
+
+	TokenSignatureSize = 16 //bytes of the HMAC-SHA256 sum kept in the token
+)
+
+const tokenValidator = `[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`
+
+// TokenStorage is a stateless DataStorage and UID validator pair, the uid is a signed token carrying its own payload.
+// The token is base64url(json record) + "." + base64url(hmac signature), so the ftp file name looks like
+// eyJwIjp7InVybCI6Imh0dHBzOi8vZXhhbXBsZS5jb20ifSwiYyI6MTYwMDAwMDAwMH0.2Hj0c1bS4Sg4x1k2qCkV0Q.html
+// Nothing is looked up on request, the token is verified and decoded.
+// Tokens are signed with the first key and verified with any of the keys, it allows to rotate the keys
+type TokenStorage struct {
+	keys [][]byte
+	rx   *regexp.Regexp
+}
+
+type tokenRecord struct {
+	Payload interface{} `json:"p,omitempty"`
+	Created int64       `json:"c"`           //unix seconds
+	Expires int64       `json:"e,omitempty"` //unix seconds, the token never expires if 0
+}
+
+// NewTokenStorage creates the token storage, the first key is used to sign new tokens
+func NewTokenStorage(keys ...[]byte) *TokenStorage {
+	if len(keys) == 0 {
+		panic("token signing key isn't defined")
+	}
+	for _, k := range keys {
+		if len(k) == 0 {
+			panic("token signing key is empty")
+		}
+	}
+	return &TokenStorage{keys: keys, rx: regexp.MustCompile("(" + tokenValidator + ")")}
+}
+
+// Encode mints the token carrying the payload, the token expires after ttl or never if ttl is 0
+func (t *TokenStorage) Encode(payload interface{}, ttl time.Duration) (string, error) {
+	now := time.Now()
+	r := tokenRecord{Payload: payload, Created: now.Unix()}
+	if ttl > 0 {
+		r.Expires = now.Add(ttl).Unix()
+	}
+	return t.encode(&r)
+}
+
+//encode signs the record with the first key
+func (t *TokenStorage) encode(r *tokenRecord) (string, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	data := base64.RawURLEncoding.EncodeToString(body)
+	return data + "." + base64.RawURLEncoding.EncodeToString(t.sign(t.keys[0], data)), nil
+}
+
+// New mints the token without a payload, it's defined to satisfy the uidgenerator.UID interface
+func (t *TokenStorage) New() string {
+	token, _ := t.Encode(nil, 0)
+	return token
+}
+
+// Validate looks for the token in the string and verifies its signature
+func (t *TokenStorage) Validate(str string) (string, error) {
+	token := t.rx.FindString(str)
+	if token == "" {
+		return "", errors.New("token isn't found in the string")
+	}
+	if _, err := t.verify(token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Validator returns the token validation regexp string
+func (t *TokenStorage) Validator() string {
+	return tokenValidator
+}
+
+// Get verifies and decodes the token, it returns ErrNFound if the token has expired
+func (t *TokenStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
+	r, err := t.verify(uid)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+
+	createdAt = time.Unix(r.Created, 0)
+	if r.Expires != 0 {
+		expiresAt := time.Unix(r.Expires, 0)
+		if !time.Now().Before(expiresAt) {
+			return nil, time.Time{}, 0, ErrNFound
+		}
+		ttl = expiresAt.Sub(createdAt)
+	}
+	return r.Payload, createdAt, ttl, nil
+}
+
+//verify checks the token signature with every key and decodes the record
+func (t *TokenStorage) verify(token string) (*tokenRecord, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, ErrBadToken
+	}
+	data := token[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return nil, ErrBadToken
+	}
+
+	valid := false
+	for _, k := range t.keys {
+		if hmac.Equal(sig, t.sign(k, data)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrBadToken
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return nil, ErrBadToken
+	}
+	r := &tokenRecord{}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, ErrBadToken
+	}
+	return r, nil
+}
+
+func (t *TokenStorage) sign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)[:TokenSignatureSize]
+}
@@ -0,0 +1,64 @@
+package datastorage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenStorage(t *testing.T) {
+	s := NewTokenStorage([]byte("secret"))
+
+	payload := map[string]interface{}{"url": "https://example.com/?a=b"}
+	token, err := s.Encode(payload, time.Hour)
+	if err != nil {
+		t.Fatalf("Can't encode the token: %v", err)
+	}
+
+	uid, err := s.Validate("/example/redirect/" + token + ".html")
+	if err != nil || uid != token {
+		t.Fatalf("Token isn't found in the path: %s, %v", uid, err)
+	}
+
+	p, c, ttl, err := s.Get(uid)
+	if err != nil {
+		t.Fatalf("Can't decode the token: %v", err)
+	}
+	if !reflect.DeepEqual(p, payload) {
+		t.Errorf("Wrong payload %v", p)
+	}
+	if dt := time.Since(c); dt < 0 || dt > 2*time.Second {
+		t.Errorf("Wrong creation time %v", c)
+	}
+	if ttl != time.Hour {
+		t.Errorf("Wrong ttl %v", ttl)
+	}
+
+	//signed with unknown key
+	forged, _ := NewTokenStorage([]byte("other")).Encode(payload, 0)
+	if _, err := s.Validate(forged + ".html"); err != ErrBadToken {
+		t.Errorf("ErrBadToken is expected for a token signed with unknown key, got %v", err)
+	}
+	if _, _, _, err := s.Get(forged[:len(forged)-1] + "A"); err != ErrBadToken {
+		t.Errorf("ErrBadToken is expected for a wrong signature, got %v", err)
+	}
+
+	//expired
+	expired, _ := s.encode(&tokenRecord{Payload: payload, Created: time.Now().Add(-2 * time.Hour).Unix(), Expires: time.Now().Add(-time.Hour).Unix()})
+	if _, _, _, err := s.Get(expired); err != ErrNFound {
+		t.Errorf("ErrNFound is expected for the expired token, got %v", err)
+	}
+	never, _ := s.Encode(payload, 0)
+	if _, _, ttl, err := s.Get(never); err != nil || ttl != 0 {
+		t.Errorf("Token without ttl must never expire, got %v, %v", ttl, err)
+	}
+
+	//key rotation: tokens signed with the old key are still valid
+	rotated := NewTokenStorage([]byte("new secret"), []byte("secret"))
+	if _, _, _, err := rotated.Get(token); err != nil {
+		t.Errorf("Token signed with the previous key is rejected: %v", err)
+	}
+	if _, _, _, err := s.Get(rotated.New()); err != ErrBadToken {
+		t.Errorf("Token signed with the new key must be rejected by the old storage, got %v", err)
+	}
+}
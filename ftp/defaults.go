@@ -0,0 +1,86 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp
+
+import (
+	"reflect"
+)
+
+// SetDefaultData sets the site-wide data merged into every record's payload before the template execution.
+// It's safe to call it at any time, so the defaults can be reloaded without rewriting the records.
+// The payload keys win over the defaults:
+//
+//   - a map payload with string keys is shallow-merged into a copy of the defaults
+//   - a struct payload (or a pointer to it) is converted to a map of its exported fields named as in the struct,
+//     the embedded structs' fields are promoted, the struct methods aren't available in the template in this case
+//   - a nil payload is replaced with the defaults
+//   - other payloads (strings, slices and so on) are passed as is, the defaults are ignored
+func (factory *DriverFactory) SetDefaultData(data map[string]interface{}) {
+	factory.defaultData.Store(data)
+}
+
+// DefaultData returns the data set with SetDefaultData
+func (factory *DriverFactory) DefaultData() map[string]interface{} {
+	data, _ := factory.defaultData.Load().(map[string]interface{})
+	return data
+}
+
+//mergeDefaults merges the payload into the defaults, see SetDefaultData
+func mergeDefaults(defaults map[string]interface{}, payload interface{}) interface{} {
+	if len(defaults) == 0 {
+		return payload
+	}
+
+	merged := make(map[string]interface{}, len(defaults))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	if payload == nil {
+		return merged
+	}
+
+	v := reflect.ValueOf(payload)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return merged
+		}
+		v = v.Elem()
+	}
+
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		iter := v.MapRange()
+		for iter.Next() {
+			merged[iter.Key().String()] = iter.Value().Interface()
+		}
+	case v.Kind() == reflect.Struct:
+		structFields(v, merged)
+	default:
+		return payload
+	}
+	return merged
+}
+
+//structFields copies the exported struct fields to the map, the embedded structs' fields are promoted
+func structFields(v reflect.Value, m map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Ptr && !fv.IsNil() {
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				structFields(fv, m)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		m[f.Name] = v.Field(i).Interface()
+	}
+}
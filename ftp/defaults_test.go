@@ -0,0 +1,44 @@
+package ftp
+
+import (
+	"reflect"
+	"testing"
+)
+
+type basePayload struct {
+	Brand string
+}
+
+type structPayload struct {
+	basePayload
+	Title  string
+	hidden string
+}
+
+func TestMergeDefaults(t *testing.T) {
+	defaults := map[string]interface{}{"Brand": "ftpdt", "Support": "https://example.com"}
+
+	tests := []struct {
+		payload  interface{}
+		expected interface{}
+	}{
+		{nil, defaults},
+		{map[string]interface{}{"Brand": "own", "Title": "t"}, map[string]interface{}{"Brand": "own", "Support": "https://example.com", "Title": "t"}},
+		{map[string]string{"Title": "t"}, map[string]interface{}{"Brand": "ftpdt", "Support": "https://example.com", "Title": "t"}},
+		{&structPayload{basePayload{"own"}, "t", "h"}, map[string]interface{}{"Brand": "own", "Support": "https://example.com", "Title": "t"}},
+		{"plain", "plain"},
+	}
+	for _, test := range tests {
+		if merged := mergeDefaults(defaults, test.payload); !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("Wrong merge of %v: %v", test.payload, merged)
+		}
+	}
+
+	payload := map[string]interface{}{"Title": "t"}
+	if merged := mergeDefaults(nil, payload); !reflect.DeepEqual(merged, payload) {
+		t.Errorf("Payload must be passed as is without defaults, got %v", merged)
+	}
+	if len(defaults) != 2 {
+		t.Error("Defaults must not be modified")
+	}
+}
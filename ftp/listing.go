@@ -0,0 +1,135 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp
+
+import (
+	"github.com/starshiptroopers/ftpdt/goftp/core"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TemplateLister is implemented by template storages which are able to enumerate their templates
+type TemplateLister interface {
+	// Templates returns ids of all templates in the storage
+	Templates() ([]string, error)
+}
+
+// DataLister is implemented by data storages which are able to enumerate their records
+type DataLister interface {
+	// Keys returns uids of all alive records in the storage
+	Keys() ([]string, error)
+}
+
+// Listing configures the directory listings, they are served with LIST, NLST and MLSD.
+// Template directories are listed as folders, every template folder contains the files
+// which can be generated from the DataStorage keys (if ExposeKeys is set) or the placeholder files.
+// Listings follow the DefaultRouter layout
+type Listing struct {
+	ExposeKeys   bool     //list the DataStorage keys as files, it leaks UIDs to anyone who can list a directory
+	Placeholders []string //file names listed in every template directory if keys aren't exposed
+	Ext          string   //extension of the listed data files, "html" is used if empty
+}
+
+// ListDir lists the template directories and the files which can be generated in them.
+// It returns ERR_NOT_SUPPORTED if listings aren't enabled
+func (d *Driver) ListDir(dir string, callback func(core.FileInfo) error) error {
+	if d.listing == nil {
+		return ERR_NOT_SUPPORTED
+	}
+
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+
+	var ids []string
+	if tl, ok := d.ts.(TemplateLister); ok {
+		var err error
+		if ids, err = tl.Templates(); err != nil {
+			return err
+		}
+	}
+
+	isTemplate := false
+	subdirs := map[string]bool{}
+	for _, id := range ids {
+		id = strings.Trim(id, "/")
+		if id == dir {
+			isTemplate = true
+			continue
+		}
+		if dir != "" && !strings.HasPrefix(id, dir+"/") {
+			continue
+		}
+		subdirs[strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(id, dir), "/"), "/", 2)[0]] = true
+	}
+
+	names := make([]string, 0, len(subdirs))
+	for name := range subdirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := callback(&file{fullname: name, body: []byte{}, created: time.Now(), dir: true}); err != nil {
+			return err
+		}
+	}
+
+	if !isTemplate {
+		return nil
+	}
+
+	for _, f := range d.listFiles(dir) {
+		if err := callback(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//listFiles returns the files of the template directory
+func (d *Driver) listFiles(dir string) []*file {
+	var files []*file
+
+	if !d.listing.ExposeKeys {
+		for _, name := range d.listing.Placeholders {
+			f, err := d.produce("/" + path.Join(dir, name))
+			if err != nil {
+				f = &file{body: []byte{}, created: time.Now()}
+			}
+			f.fullname = name
+			files = append(files, f)
+		}
+		return files
+	}
+
+	dl, ok := d.ps.(DataLister)
+	if !ok {
+		return nil
+	}
+
+	keys, err := dl.Keys()
+	if err != nil {
+		d.logger.Printf("%sWARN can't list the data keys: %v", LOG_PREFIX, err)
+		return nil
+	}
+	sort.Strings(keys)
+
+	ext := d.listing.Ext
+	if ext == "" {
+		ext = "html"
+	}
+
+	for _, key := range keys {
+		name := key + "." + ext
+		f, err := d.produce("/" + path.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		f.fullname = name
+		files = append(files, f)
+	}
+	return files
+}
@@ -0,0 +1,89 @@
+package ftp
+
+import (
+	"errors"
+	"github.com/starshiptroopers/ftpdt/goftp/core"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+type listingTemplates struct{}
+
+func (listingTemplates) Template(id string) (Template, error) {
+	if id != "example/redirect" {
+		return nil, errors.New("not found")
+	}
+	return template.New(id).Parse("{{.}}")
+}
+
+func (listingTemplates) Templates() ([]string, error) {
+	return []string{"example/redirect", "other"}, nil
+}
+
+type listingData struct{}
+
+func (listingData) Get(uid string) (interface{}, time.Time, time.Duration, error) {
+	if uid != "abcde" {
+		return nil, time.Time{}, 0, errors.New("not found")
+	}
+	return "payload", time.Now(), 0, nil
+}
+
+func (listingData) Keys() ([]string, error) {
+	return []string{"abcde"}, nil
+}
+
+type anyUID struct{}
+
+func (anyUID) Validate(s string) (string, error) {
+	if len(s) < 5 {
+		return "", errors.New("uid isn't found")
+	}
+	return s[:5], nil
+}
+
+func list(t *testing.T, d core.Driver, path string) map[string]core.FileInfo {
+	files := map[string]core.FileInfo{}
+	err := d.ListDir(path, func(f core.FileInfo) error {
+		files[f.Name()] = f
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListDir %s returns error: %v", path, err)
+	}
+	return files
+}
+
+func TestListDir(t *testing.T) {
+	factory := NewDriverFactory(listingTemplates{}, listingData{}, anyUID{}, log.New(ioutil.Discard, "", 0))
+
+	d, _ := factory.NewDriver()
+	if err := d.ListDir("/", func(core.FileInfo) error { return nil }); err != ERR_NOT_SUPPORTED {
+		t.Errorf("ERR_NOT_SUPPORTED is expected if listings are disabled, got %v", err)
+	}
+
+	factory.Listing = &Listing{Placeholders: []string{"index.html"}}
+	d, _ = factory.NewDriver()
+
+	root := list(t, d, "/")
+	if len(root) != 2 || !root["example"].IsDir() || !root["other"].IsDir() {
+		t.Errorf("Wrong root listing: %v", root)
+	}
+
+	files := list(t, d, "/example/redirect")
+	if len(files) != 1 || files["index.html"] == nil || files["index.html"].IsDir() {
+		t.Errorf("Placeholder is expected in the template directory: %v", files)
+	}
+
+	factory.Listing = &Listing{ExposeKeys: true}
+	d, _ = factory.NewDriver()
+
+	files = list(t, d, "/example/redirect")
+	f := files["abcde.html"]
+	if len(files) != 1 || f == nil || f.IsDir() || f.Size() != int64(len("payload")) {
+		t.Errorf("Data keys are expected in the template directory: %v", files)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	ERR_EXTENSION_DENIED = errors.New("file extension isn't allowed by the template")
+	ERR_MISSING_FIELD    = errors.New("required payload field is missing")
+	ERR_TOO_LARGE        = errors.New("produced file is too large")
+)
+
+// TemplateMeta is a template metadata declared by the template storage, the producer enforces it
+type TemplateMeta struct {
+	Kind       string        //output content kind, "html" or "text"
+	Extensions []string      //allowed extensions of the requested file without the dot, any extension is allowed if empty
+	Required   []string      //payload fields which must be present and not empty
+	MaxSize    int64         //max size of the produced file in bytes, unlimited if 0
+	CacheTTL   time.Duration //how long the storage caches the parsed template, the storage's default is used if 0
+}
+
+// MetaTemplate is a Template which carries its metadata
+type MetaTemplate interface {
+	Template
+	Meta() *TemplateMeta
+}
+
+//checkRequest checks the requested file extension resolved by the router and the payload against the template metadata
+func (m *TemplateMeta) checkRequest(ext string, payload interface{}) error {
+	if len(m.Extensions) > 0 {
+		allowed := false
+		for _, e := range m.Extensions {
+			if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s", ERR_EXTENSION_DENIED, ext)
+		}
+	}
+
+	for _, field := range m.Required {
+		if !hasField(payload, field) {
+			return fmt.Errorf("%w: %s", ERR_MISSING_FIELD, field)
+		}
+	}
+	return nil
+}
+
+//hasField reports whether the payload map or struct has the not empty field
+func hasField(payload interface{}, field string) bool {
+	v := reflect.ValueOf(payload)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	var f reflect.Value
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return false
+		}
+		f = v.MapIndex(reflect.ValueOf(field).Convert(v.Type().Key()))
+	case reflect.Struct:
+		f = v.FieldByName(field)
+	default:
+		return false
+	}
+
+	for f.IsValid() && f.Kind() == reflect.Interface {
+		f = f.Elem()
+	}
+	return f.IsValid() && !f.IsZero()
+}
+
+//limitedWriter fails once more than n bytes are written
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, ERR_TOO_LARGE
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
@@ -9,24 +9,46 @@ package ftp
 import (
 	"bytes"
 	"errors"
-	"goftp.io/server/core"
-	"html/template"
+	"fmt"
+	"github.com/starshiptroopers/ftpdt/goftp/core"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	ERR_NOT_SUPPORTED = errors.New("operation isn't supported")
 	ERR_WRONG_PATH    = errors.New("wrong path")
-	LOG_PREFIX        = "FTPDT "
+
+	//template errors, template storages should wrap them, so they can be checked with errors.Is
+	ERR_TEMPLATE_NOT_FOUND = errors.New("template not found")
+	ERR_TEMPLATE_PARSE     = errors.New("template parse error")
+	ERR_TEMPLATE_EXEC      = errors.New("template execution error")
+	LOG_PREFIX             = "FTPDT "
 )
 
+// Template is a parsed template which produces the file content, both html/template and text/template satisfy it
+type Template interface {
+	Execute(wr io.Writer, data interface{}) error
+}
+
 type TemplateStorage interface {
-	Template(id string) (*template.Template, error)
+	Template(id string) (Template, error)
+}
+
+// TemplateFuncs is implemented by template storages which accept the custom template functions
+type TemplateFuncs interface {
+	Funcs(funcs map[string]interface{})
+}
+
+// TemplatePrecompiler is implemented by template storages which are able to parse all their templates in advance
+type TemplatePrecompiler interface {
+	// Precompile parses every template and returns an error if any of them is broken
+	Precompile() error
 }
 
 type DataStorage interface {
@@ -44,12 +66,20 @@ type Driver struct {
 	ts           TemplateStorage
 	ps           DataStorage
 	uidGenerator UID
+	router       Router
+	listing      *Listing
+	auth         core.Auth
+	upload       *Upload
+	session      *Session //nil if the driver is created outside the ftp session
+	factory      *DriverFactory
+	writable     bool              //the session is allowed to upload
+	receipts     map[string][]byte //uploaded file path -> generated uid and path
 	fileCache    map[string]string
 	logger       *log.Logger
 }
 
 // Stat return FileInfo for entity located at path
-func (d Driver) Stat(filename string) (core.FileInfo, error) {
+func (d *Driver) Stat(filename string) (core.FileInfo, error) {
 
 	p, err := d.produce(filename)
 
@@ -64,9 +94,10 @@ func (d Driver) Stat(filename string) (core.FileInfo, error) {
 			fullname: filename,
 			body:     []byte{},
 			created:  time.Now(),
+			dir:      true,
 		}, nil
 	} else if err != nil {
-		d.logger.Printf("%sWARN %s %v", LOG_PREFIX, filename, err)
+		d.logError(filename, err)
 		return nil, errors.New("file unavailable")
 	}
 
@@ -75,24 +106,25 @@ func (d Driver) Stat(filename string) (core.FileInfo, error) {
 
 //implements a dummy readerCloser required by goftp driver interface
 type readCloser struct {
-	f *file
-	l *log.Logger
+	f      *file
+	l      *log.Logger
+	client string
 	io.Reader
 }
 
 func (rc readCloser) Close() error {
-	rc.l.Printf("%sGET %s", LOG_PREFIX, rc.f.Name())
+	rc.l.Printf("%sGET %s%s", LOG_PREFIX, rc.f.Name(), rc.client)
 	return nil
 }
 
 // GetFile expose the content of a filename as an io.ReadCloser interface
 // returns size, io.ReadCloser interface and error on errors
-func (d Driver) GetFile(filename string, offset int64) (int64, io.ReadCloser, error) {
+func (d *Driver) GetFile(filename string, offset int64) (int64, io.ReadCloser, error) {
 
 	p, err := d.produce(filename)
 
 	if err != nil {
-		d.logger.Printf("%sWARN %s %v", LOG_PREFIX, filename, err)
+		d.logError(filename, err)
 		return 0, nil, errors.New("file unavailable")
 	}
 
@@ -102,58 +134,126 @@ func (d Driver) GetFile(filename string, offset int64) (int64, io.ReadCloser, er
 		return 0, nil, io.EOF
 	}
 
-	rc := readCloser{p, d.logger, bytes.NewReader(p.body[offset:])}
+	rc := readCloser{p, d.logger, d.client(), bytes.NewReader(p.body[offset:])}
 	return length - offset, &rc, nil
 }
 
-//parse the file path and invoke template and data ids
-func (d Driver) parsePath(path string) (uid string, templateId string, err error) {
-	paths := strings.Split(path, string(filepath.Separator))
+//logError logs the file production error, the broken templates are reported as errors, other failures as warnings
+func (d *Driver) logError(filename string, err error) {
+	if IsTemplateError(err) {
+		d.logger.Printf("%sERROR %s %v%s", LOG_PREFIX, filename, err, d.client())
+	} else {
+		d.logger.Printf("%sWARN %s %v%s", LOG_PREFIX, filename, err, d.client())
+	}
+}
 
-	//relative paths isn't supported
-	if paths[0] == "." || paths[0] == ".." {
-		if len(paths) == 1 {
-			return "", "", ERR_WRONG_PATH
-		}
-		paths = paths[1:]
+// Init implements goftp ConnDriver, the session gets the goftp session id, so it matches the ftp debug log
+func (d *Driver) Init(conn *core.Conn) {
+	if d.session != nil {
+		d.session.ID = conn.SessionID()
+	}
+}
+
+//client returns the client ip of the session appended to the log records, it's the real client ip behind the PROXY protocol balancers
+func (d *Driver) client() string {
+	if d.session == nil || d.session.ClientIP == "" {
+		return ""
 	}
+	return " from " + d.session.ClientIP
+}
+
+// IsTemplateError reports whether err is caused by a broken template rather than by a wrong path or missing data
+func IsTemplateError(err error) bool {
+	return errors.Is(err, ERR_TEMPLATE_PARSE) || errors.Is(err, ERR_TEMPLATE_EXEC)
+}
 
-	filename := paths[len(paths)-1]
-	if filename == "" {
-		return "", "", ERR_WRONG_PATH
+//parse the file path and invoke template and data ids and the requested file extension
+func (d *Driver) parsePath(filepath string) (uid string, templateId string, ext string, err error) {
+	route, err := d.router.Route(filepath)
+	if err != nil {
+		return "", "", "", err
 	}
 
-	uid, err = d.uidGenerator.Validate(filename)
+	uid, err = d.uidGenerator.Validate(route.Uid)
 	if err != nil {
-		return "", "", ERR_WRONG_PATH
+		return "", "", "", ERR_WRONG_PATH
 	}
 
-	templateId = filepath.Join(paths[:len(paths)-1]...)
-	return
+	ext = route.Params["ext"]
+	if ext == "" {
+		ext = strings.TrimPrefix(path.Ext(filepath), ".")
+	}
+	return uid, route.TemplateId, ext, nil
+}
+
+//template returns the template rendering the files with the extension, it's the templateId.ext template if it exists,
+//so uid.html and uid.txt can be rendered from the same record with the sibling templates, templateId otherwise.
+//The siblings of the default template (empty templateId) are default.ext ones
+func (d *Driver) template(templateId string, ext string) (Template, error) {
+	if ext != "" {
+		sibling := templateId
+		if sibling == "" {
+			sibling = "default"
+		}
+		t, err := d.ts.Template(sibling + "." + ext)
+		if err == nil || IsTemplateError(err) {
+			return t, err
+		}
+	}
+	return d.ts.Template(templateId)
 }
 
 //invoke template and data ids from filepath and generate the file content
-func (d Driver) produce(filepath string) (*file, error) {
+func (d *Driver) produce(filepath string) (*file, error) {
+
+	if receipt, ok := d.receipts[filepath]; ok {
+		return &file{
+			fullname: filepath,
+			body:     receipt,
+			created:  time.Now(),
+		}, nil
+	}
 
-	uid, templateId, err := d.parsePath(filepath)
+	uid, templateId, ext, err := d.parsePath(filepath)
 	if err != nil {
 		return nil, err
 	}
 
-	t, err := d.ts.Template(templateId)
+	t, err := d.template(templateId, ext)
 	if err != nil {
 		return nil, err
 	}
 
-	payload, createdAt, _, err := d.ps.Get(uid)
+	payload, createdAt, ttl, err := d.ps.Get(uid)
 	if err != nil {
 		return nil, err
 	}
+	payload = mergeDefaults(d.factory.DefaultData(), payload)
 
-	//fill the template
+	var w io.Writer
 	var b bytes.Buffer
-	if err = t.Execute(&b, payload); err != nil {
-		return nil, err
+	w = &b
+
+	if mt, ok := t.(MetaTemplate); ok {
+		meta := mt.Meta()
+		if err := meta.checkRequest(ext, payload); err != nil {
+			return nil, err
+		}
+		if meta.MaxSize > 0 {
+			w = &limitedWriter{&b, meta.MaxSize}
+		}
+	}
+
+	var data interface{} = payload
+	if d.factory.RequestContext {
+		data = d.requestContext(filepath, ext, payload, createdAt, ttl)
+	}
+
+	//fill the template
+	if err = t.Execute(w, data); errors.Is(err, ERR_TOO_LARGE) {
+		return nil, fmt.Errorf("%w: %s", ERR_TOO_LARGE, templateId)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ERR_TEMPLATE_EXEC, templateId, err)
 	}
 
 	return &file{
@@ -163,55 +263,124 @@ func (d Driver) produce(filepath string) (*file, error) {
 	}, nil
 }
 
-// ListDir defined to satisfy goftp driver interface, but not implemented and always returns an error
-func (d Driver) ListDir(string, func(core.FileInfo) error) error {
-	return ERR_NOT_SUPPORTED
+//requestContext wraps the payload with the request details
+func (d *Driver) requestContext(filepath string, ext string, payload interface{}, createdAt time.Time, ttl time.Duration) *RequestContext {
+	c := &RequestContext{
+		Payload:   payload,
+		Hostname:  d.factory.Hostname,
+		Port:      d.factory.Port,
+		Path:      filepath,
+		Ext:       ext,
+		CreatedAt: createdAt,
+		TTL:       ttl,
+		Now:       time.Now(),
+	}
+	if ttl > 0 {
+		c.ExpiresAt = createdAt.Add(ttl)
+	}
+	if d.session != nil {
+		c.ClientIP = d.session.ClientIP
+		c.SessionId = d.session.ID
+	}
+	return c
 }
 
 // DeleteDir defined to satisfy goftp driver interface, but not implemented and always returns an error
-func (d Driver) DeleteDir(string) error {
+func (d *Driver) DeleteDir(string) error {
 	return ERR_NOT_SUPPORTED
 }
 
 // DeleteFile defined to satisfy goftp driver interface, but not implemented and always returns an error
-func (d Driver) DeleteFile(string) error {
+func (d *Driver) DeleteFile(string) error {
 	return ERR_NOT_SUPPORTED
 }
 
 // Rename defined to satisfy goftp driver interface, but not implemented and always returns an error
-func (d Driver) Rename(string, string) error {
+func (d *Driver) Rename(string, string) error {
 	return ERR_NOT_SUPPORTED
 }
 
 // MakeDir defined to satisfy goftp driver interface, but not implemented and always returns an error
-func (d Driver) MakeDir(string) error {
+func (d *Driver) MakeDir(string) error {
 	return ERR_NOT_SUPPORTED
 }
 
-// PutFile defined to satisfy goftp driver interface, but not implemented and always returns an error
-func (d Driver) PutFile(string, io.Reader, bool) (int64, error) {
-	return 0, ERR_NOT_SUPPORTED
-}
-
 // Implements DriverFactory which creates Driver instance for each ftp client connection
 type DriverFactory struct {
 	ts           TemplateStorage
 	ps           DataStorage
 	uidGenerator UID
 	logger       *log.Logger
+
+	Router  Router    //maps the ftp path to the template and data ids, DefaultRouter is used by default
+	Listing *Listing  //directory listings options, listings are disabled if nil
+	Auth    core.Auth //authenticates the ftp users if Upload is set (AuthAnonymous is used if nil), the ServerOpts.Auth is used otherwise
+	Upload  *Upload   //upload-to-data mode options, uploads are disabled if nil
+
+	RequestContext bool   //pass the RequestContext to the templates instead of the raw payload
+	Hostname       string //server's public hostname exposed in the RequestContext, the links aren't built if it's empty
+	Port           int    //server's port exposed in the RequestContext
+
+	defaultData atomic.Value //site-wide data merged into the payloads, see SetDefaultData
 }
 
 // Create Driver instance for each ftp client connection
 func (factory *DriverFactory) NewDriver() (core.Driver, error) {
+	return factory.sessionDriver(nil)
+}
+
+//sessionDriver creates the driver of the ftp session, it authenticates the users only if the uploads are enabled
+func (factory *DriverFactory) sessionDriver(session *Session) (core.Driver, error) {
+	d, err := factory.newDriver(session)
+	if err != nil {
+		return nil, err
+	}
+	if d.upload == nil {
+		return d, nil
+	}
+	return uploadDriver{d}, nil
+}
+
+func (factory *DriverFactory) newDriver(session *Session) (*Driver, error) {
+	router := factory.Router
+	if router == nil {
+		router = DefaultRouter{}
+	}
+	auth := factory.Auth
+	if auth == nil {
+		auth = &AuthAnonymous{}
+	}
 	return &Driver{
-		factory.ts,
-		factory.ps,
-		factory.uidGenerator,
-		make(map[string]string),
-		factory.logger,
+		ts:           factory.ts,
+		ps:           factory.ps,
+		uidGenerator: factory.uidGenerator,
+		router:       router,
+		listing:      factory.Listing,
+		auth:         auth,
+		upload:       factory.Upload,
+		session:      session,
+		factory:      factory,
+		receipts:     make(map[string][]byte),
+		fileCache:    make(map[string]string),
+		logger:       factory.logger,
 	}, nil
 }
 
+// Produce generates the content of the file located at path the same way the ftp driver does,
+// it allows to expose generated files over other protocols
+func (factory *DriverFactory) Produce(path string) (body []byte, modTime time.Time, err error) {
+	d, err := factory.newDriver(nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	f, err := d.produce(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return f.body, f.created, nil
+}
+
 //NewDriverFactory create the instance of DriverFactory
 func NewDriverFactory(ts TemplateStorage, ps DataStorage, uidGenerator UID, logger *log.Logger) *DriverFactory {
 
@@ -229,5 +398,5 @@ func NewDriverFactory(ts TemplateStorage, ps DataStorage, uidGenerator UID, logg
 	if logger == nil {
 		logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
-	return &DriverFactory{ts, ps, uidGenerator, logger}
+	return &DriverFactory{ts: ts, ps: ps, uidGenerator: uidGenerator, logger: logger, Router: DefaultRouter{}}
 }
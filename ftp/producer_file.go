@@ -14,6 +14,7 @@ type file struct {
 	fullname string //full filename
 	body     []byte //file file
 	created  time.Time
+	dir      bool
 }
 
 func (i *file) Name() string {
@@ -33,7 +34,7 @@ func (i *file) ModTime() time.Time {
 }
 
 func (i *file) IsDir() bool {
-	return i.Size() == 0
+	return i.dir
 }
 
 func (i *file) Sys() interface{} {
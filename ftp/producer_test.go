@@ -0,0 +1,125 @@
+package ftp
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+type metaTemplate struct {
+	Template
+	meta *TemplateMeta
+}
+
+func (t metaTemplate) Meta() *TemplateMeta {
+	return t.meta
+}
+
+type brokenTemplates struct{}
+
+func (brokenTemplates) Template(id string) (Template, error) {
+	switch id {
+	case "exec":
+		return template.New(id).Parse("{{.Field}}")
+	case "parse":
+		return nil, ERR_TEMPLATE_PARSE
+	case "meta":
+		tmpl, err := template.New(id).Parse("{{.}}")
+		return metaTemplate{tmpl, &TemplateMeta{Extensions: []string{"html"}, MaxSize: 7}}, err
+	case "required":
+		tmpl, err := template.New(id).Parse("{{.}}")
+		return metaTemplate{tmpl, &TemplateMeta{Required: []string{"url"}}}, err
+	}
+	return nil, ERR_TEMPLATE_NOT_FOUND
+}
+
+func TestProduceErrors(t *testing.T) {
+	factory := NewDriverFactory(brokenTemplates{}, listingData{}, anyUID{}, log.New(ioutil.Discard, "", 0))
+
+	tests := []struct {
+		path     string
+		expected error
+	}{
+		{"/exec/abcde.html", ERR_TEMPLATE_EXEC},
+		{"/parse/abcde.html", ERR_TEMPLATE_PARSE},
+		{"/missing/abcde.html", ERR_TEMPLATE_NOT_FOUND},
+		{"/meta/abcde.exe", ERR_EXTENSION_DENIED},
+		{"/required/abcde.html", ERR_MISSING_FIELD},
+	}
+	for _, test := range tests {
+		_, _, err := factory.Produce(test.path)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: %v is expected, got %v", test.path, test.expected, err)
+		}
+		if IsTemplateError(err) != (test.expected == ERR_TEMPLATE_EXEC || test.expected == ERR_TEMPLATE_PARSE) {
+			t.Errorf("%s: wrong IsTemplateError result for %v", test.path, err)
+		}
+	}
+}
+
+func TestTemplateMeta(t *testing.T) {
+	factory := NewDriverFactory(brokenTemplates{}, listingData{}, anyUID{}, log.New(ioutil.Discard, "", 0))
+
+	if body, _, err := factory.Produce("/meta/abcde.html"); err != nil || string(body) != "payload" {
+		t.Errorf("Wrong produced file %s, %v", body, err)
+	}
+
+	//the extension is the one resolved by the router rather than the file name's one
+	factory.Router, _ = NewPatternRouter("/{ext}/{tmpl}/{uid}", "")
+	if body, _, err := factory.Produce("/html/meta/abcde"); err != nil || string(body) != "payload" {
+		t.Errorf("Wrong produced file %s, %v", body, err)
+	}
+	if _, _, err := factory.Produce("/exe/meta/abcde.html"); !errors.Is(err, ERR_EXTENSION_DENIED) {
+		t.Errorf("ERR_EXTENSION_DENIED is expected, got %v", err)
+	}
+
+	m := &TemplateMeta{Required: []string{"url"}, MaxSize: 3}
+	if err := m.checkRequest("html", map[string]interface{}{"url": "x"}); err != nil {
+		t.Errorf("Payload with the required field is rejected: %v", err)
+	}
+	if err := m.checkRequest("html", map[string]interface{}{"url": ""}); !errors.Is(err, ERR_MISSING_FIELD) {
+		t.Errorf("ERR_MISSING_FIELD is expected for an empty field, got %v", err)
+	}
+
+	var b bytes.Buffer
+	tmpl, _ := template.New("").Parse("{{.}}")
+	if err := tmpl.Execute(&limitedWriter{&b, m.MaxSize}, "abcd"); !errors.Is(err, ERR_TOO_LARGE) {
+		t.Errorf("ERR_TOO_LARGE is expected, got %v", err)
+	}
+}
+
+type siblingTemplates struct{}
+
+func (siblingTemplates) Template(id string) (Template, error) {
+	switch id {
+	case "redirect", "redirect.txt", "default.txt":
+		return template.New(id).Parse(id + " {{.}}")
+	case "":
+		return template.New(id).Parse("default {{.}}")
+	}
+	return nil, ERR_TEMPLATE_NOT_FOUND
+}
+
+func TestSiblingTemplates(t *testing.T) {
+	factory := NewDriverFactory(siblingTemplates{}, listingData{}, anyUID{}, log.New(ioutil.Discard, "", 0))
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/redirect/abcde.txt", "redirect.txt payload"},
+		{"/redirect/abcde.html", "redirect payload"},
+		{"/redirect/abcde", "redirect payload"},
+		{"/abcde.txt", "default.txt payload"},
+		{"/abcde.html", "default payload"},
+	}
+	for _, test := range tests {
+		body, _, err := factory.Produce(test.path)
+		if err != nil || string(body) != test.expected {
+			t.Errorf("%s: wrong produced file %s, %v", test.path, body, err)
+		}
+	}
+}
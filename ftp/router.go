@@ -0,0 +1,163 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Route is the result of mapping the ftp file path to the template and the data
+type Route struct {
+	TemplateId string            //template id the TemplateStorage is requested with
+	Uid        string            //data key, it's validated with the UID validator before invoking the data
+	Params     map[string]string //extra params extracted from the path
+}
+
+// Router maps the ftp file path to the Route
+// Route should return ERR_WRONG_PATH if the path doesn't match
+type Router interface {
+	Route(path string) (*Route, error)
+}
+
+// DefaultRouter treats the last path element as the UID and everything before it as the template id
+// For example, /example/redirect/abcde.txt is mapped to the template "example/redirect" and uid "abcde.txt"
+type DefaultRouter struct{}
+
+// Route implements Router
+func (DefaultRouter) Route(path string) (*Route, error) {
+	paths := strings.Split(path, string(filepath.Separator))
+
+	//relative paths isn't supported
+	if paths[0] == "." || paths[0] == ".." {
+		if len(paths) == 1 {
+			return nil, ERR_WRONG_PATH
+		}
+		paths = paths[1:]
+	}
+
+	filename := paths[len(paths)-1]
+	if filename == "" {
+		return nil, ERR_WRONG_PATH
+	}
+
+	return &Route{
+		TemplateId: filepath.Join(paths[:len(paths)-1]...),
+		Uid:        filename,
+		Params:     map[string]string{},
+	}, nil
+}
+
+// RegexRouter maps the path to the Route with a regular expression
+// The expression must have the named group "uid", the other named groups are returned as the route params
+type RegexRouter struct {
+	rx         *regexp.Regexp
+	templateId string
+}
+
+// NewRegexRouter creates a RegexRouter from expr.
+// templateId is expanded with the matched groups (regexp.Expand syntax, e.g. "campaign/${name}"),
+// if it's empty, the named group "tmpl" is used as a template id
+func NewRegexRouter(expr string, templateId string) (*RegexRouter, error) {
+	rx, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	hasUid := false
+	for _, name := range rx.SubexpNames() {
+		if name == "uid" {
+			hasUid = true
+		}
+	}
+	if !hasUid {
+		return nil, fmt.Errorf("router expression %s doesn't have the uid group", expr)
+	}
+
+	if templateId == "" {
+		templateId = "${tmpl}"
+	}
+	return &RegexRouter{rx, templateId}, nil
+}
+
+// Route implements Router
+func (r *RegexRouter) Route(path string) (*Route, error) {
+	m := r.rx.FindStringSubmatchIndex(path)
+	if m == nil {
+		return nil, ERR_WRONG_PATH
+	}
+
+	route := &Route{Params: map[string]string{}}
+	for i, name := range r.rx.SubexpNames() {
+		if name == "" || m[2*i] < 0 {
+			continue
+		}
+		value := path[m[2*i]:m[2*i+1]]
+		switch name {
+		case "uid":
+			route.Uid = value
+		case "tmpl":
+		default:
+			route.Params[name] = value
+		}
+	}
+
+	if route.Uid == "" {
+		return nil, ERR_WRONG_PATH
+	}
+
+	route.TemplateId = strings.Trim(string(r.rx.ExpandString(nil, r.templateId, path, m)), "/")
+	return route, nil
+}
+
+var patternParam = regexp.MustCompile(`{([a-zA-Z_][a-zA-Z0-9_]*)(\.\.\.)?}`)
+
+// NewPatternRouter creates a router from the path pattern like /{tmpl...}/{uid}.{ext} or /campaign/{name}/{uid}.html
+// {name} matches a single path element, {name...} matches one or more path elements.
+// {uid} is the data key, {tmpl} is the template id, other params are returned in the Route.Params.
+// templateId is expanded with the params as in NewRegexRouter, e.g. "campaign/${name}"
+func NewPatternRouter(pattern string, templateId string) (*RegexRouter, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		pattern = "/" + pattern
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	last := 0
+	for _, m := range patternParam.FindAllStringSubmatchIndex(pattern, -1) {
+		expr.WriteString(regexp.QuoteMeta(pattern[last:m[0]]))
+		name := pattern[m[2]:m[3]]
+		if m[4] >= 0 {
+			expr.WriteString("(?P<" + name + ">[^/]+(?:/[^/]+)*?)")
+		} else if name == "ext" {
+			expr.WriteString("(?P<" + name + ">[^/.]+)")
+		} else {
+			expr.WriteString("(?P<" + name + ">[^/]+?)")
+		}
+		last = m[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+	expr.WriteString("$")
+
+	return NewRegexRouter(expr.String(), templateId)
+}
+
+// Routers is a Router which tries each of its routers in order, the first match wins.
+// It allows to expose several url layouts from one server
+type Routers []Router
+
+// Route implements Router
+func (rs Routers) Route(path string) (*Route, error) {
+	for _, r := range rs {
+		route, err := r.Route(path)
+		if err == ERR_WRONG_PATH {
+			continue
+		}
+		return route, err
+	}
+	return nil, ERR_WRONG_PATH
+}
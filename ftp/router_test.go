@@ -0,0 +1,86 @@
+package ftp
+
+import (
+	"testing"
+)
+
+func TestDefaultRouter(t *testing.T) {
+	r := DefaultRouter{}
+
+	route, err := r.Route("/example/redirect/abcde.txt")
+	if err != nil {
+		t.Fatalf("Route returns error: %v", err)
+	}
+	if route.TemplateId != "example/redirect" || route.Uid != "abcde.txt" {
+		t.Errorf("Wrong route: %+v", route)
+	}
+
+	if _, err := r.Route("/example/redirect/"); err != ERR_WRONG_PATH {
+		t.Errorf("ERR_WRONG_PATH is expected for a directory path, got %v", err)
+	}
+}
+
+func TestPatternRouter(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		templateId string
+		path       string
+		tmpl       string
+		uid        string
+		params     map[string]string
+	}{
+		{"/{tmpl...}/{uid}.{ext}", "", "/example/redirect/abcde.txt", "example/redirect", "abcde", map[string]string{"ext": "txt"}},
+		{"/{tmpl...}/{uid}.{ext}", "", "/a/b.c.html", "a", "b.c", map[string]string{"ext": "html"}},
+		{"/r/{uid}", "redirect", "/r/abcde", "redirect", "abcde", map[string]string{}},
+		{"/campaign/{name}/{uid}.html", "campaign/${name}", "/campaign/spring/abcde.html", "campaign/spring", "abcde", map[string]string{"name": "spring"}},
+	}
+
+	for _, test := range tests {
+		r, err := NewPatternRouter(test.pattern, test.templateId)
+		if err != nil {
+			t.Fatalf("Can't create the router for %s: %v", test.pattern, err)
+		}
+		route, err := r.Route(test.path)
+		if err != nil {
+			t.Errorf("%s: Route returns error for %s: %v", test.pattern, test.path, err)
+			continue
+		}
+		if route.TemplateId != test.tmpl || route.Uid != test.uid {
+			t.Errorf("%s: wrong route for %s: %+v", test.pattern, test.path, route)
+		}
+		for k, v := range test.params {
+			if route.Params[k] != v {
+				t.Errorf("%s: wrong param %s for %s: %s", test.pattern, k, test.path, route.Params[k])
+			}
+		}
+	}
+
+	r, _ := NewPatternRouter("/r/{uid}", "redirect")
+	if _, err := r.Route("/x/abcde"); err != ERR_WRONG_PATH {
+		t.Errorf("ERR_WRONG_PATH is expected for not matched path, got %v", err)
+	}
+
+	if _, err := NewPatternRouter("/r/{id}", "redirect"); err == nil {
+		t.Error("Pattern without uid must be rejected")
+	}
+}
+
+func TestRouters(t *testing.T) {
+	short, _ := NewPatternRouter("/r/{uid}", "redirect")
+	campaign, _ := NewRegexRouter(`^/campaign/(?P<name>[a-z]+)/(?P<uid>[a-z]+)\.html$`, "campaign/${name}")
+	r := Routers{short, campaign}
+
+	route, err := r.Route("/campaign/spring/abcde.html")
+	if err != nil || route.TemplateId != "campaign/spring" {
+		t.Errorf("Wrong route %+v, %v", route, err)
+	}
+
+	route, err = r.Route("/r/abcde")
+	if err != nil || route.TemplateId != "redirect" {
+		t.Errorf("Wrong route %+v, %v", route, err)
+	}
+
+	if _, err := r.Route("/other/abcde"); err != ERR_WRONG_PATH {
+		t.Errorf("ERR_WRONG_PATH is expected, got %v", err)
+	}
+}
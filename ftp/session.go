@@ -0,0 +1,115 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp
+
+import (
+	"github.com/starshiptroopers/ftpdt/goftp/core"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session describes the ftp client connection the Driver serves
+type Session struct {
+	ID       string //goftp session id the ftp debug log is written with, empty until the driver is initialized with the connection
+	ClientIP string
+}
+
+// RequestContext is passed to the templates instead of the raw payload if DriverFactory.RequestContext is set,
+// the payload is available as {{.Payload}}
+type RequestContext struct {
+	Payload   interface{}
+	ClientIP  string //empty if the file is produced outside the ftp session
+	SessionId string //empty if the file is produced outside the ftp session
+	Hostname  string //server's public hostname, empty if it isn't known (FtpOpts PublicIP isn't set and the server listens on all the addresses)
+	Port      int    //server's port
+	Path      string //requested file path
+	Ext       string //requested file extension without the dot
+	CreatedAt time.Time
+	TTL       time.Duration
+	ExpiresAt time.Time //zero if the record never expires
+	Now       time.Time
+}
+
+// URL returns the absolute ftp url of the path on this server, the requested file url if path is empty.
+// It allows to build links back to the server: <a href="{{.URL "/example/redirect/abcde.txt"}}">.
+// It returns an empty string if the server's public hostname isn't known
+func (c *RequestContext) URL(path string) string {
+	if c.Hostname == "" {
+		return ""
+	}
+	if path == "" {
+		path = c.Path
+	}
+	host := c.Hostname
+	if c.Port != 0 && c.Port != 21 {
+		host = net.JoinHostPort(host, strconv.Itoa(c.Port))
+	}
+	return "ftp://" + host + "/" + strings.TrimPrefix(path, "/")
+}
+
+// ExpiresIn returns the time left until the record expires, it's 0 if the record never expires or has expired
+func (c *RequestContext) ExpiresIn() time.Duration {
+	if c.ExpiresAt.IsZero() || !c.Now.Before(c.ExpiresAt) {
+		return 0
+	}
+	return c.ExpiresAt.Sub(c.Now)
+}
+
+//sessionListener keeps the session of the last accepted connection,
+//goftp creates the driver right after accepting the connection in the same goroutine
+type sessionListener struct {
+	net.Listener
+	mu      sync.Mutex
+	session *Session
+}
+
+// Accept implements net.Listener
+func (l *sessionListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		s.ClientIP = host
+	}
+
+	l.mu.Lock()
+	l.session = s
+	l.mu.Unlock()
+	return conn, nil
+}
+
+//take returns the session of the last accepted connection, it's returned only once
+func (l *sessionListener) take() *Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.session
+	l.session = nil
+	return s
+}
+
+//sessionFactory creates the drivers for the connections accepted from its listener
+type sessionFactory struct {
+	factory  *DriverFactory
+	listener *sessionListener
+}
+
+// NewDriver implements goftp DriverFactory, the session id is set by Driver.Init
+func (f *sessionFactory) NewDriver() (core.Driver, error) {
+	return f.factory.sessionDriver(f.listener.take())
+}
+
+// Listen wraps the listener, so the drivers know the sessions of the connections accepted from it.
+// Pass the returned listener to the goftp Server.Serve and the returned factory to its ServerOpts.Factory.
+// Every listener needs its own factory, so several goftp servers can share the DriverFactory
+func (factory *DriverFactory) Listen(l net.Listener) (net.Listener, core.DriverFactory) {
+	sl := &sessionListener{Listener: l}
+	return sl, &sessionFactory{factory, sl}
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/starshiptroopers/ftpdt/goftp/core"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ERR_UPLOAD_DENIED    = errors.New("upload isn't allowed")
+	ERR_UPLOAD_FORMAT    = errors.New("unsupported upload format")
+	ERR_UPLOAD_TOO_LARGE = errors.New("uploaded file is too large")
+
+	DefaultUploadMaxSize int64 = 64 << 10 //bytes
+)
+
+// WritableDataStorage is a DataStorage which is able to store the records
+type WritableDataStorage interface {
+	DataStorage
+	Put(uid string, payload interface{}, ttl *time.Duration) error
+}
+
+// DeletableDataStorage is a DataStorage which is able to delete the records
+type DeletableDataStorage interface {
+	DataStorage
+	Delete(uid string) error
+}
+
+// UIDGenerator is a UID validator which is able to generate new uids
+type UIDGenerator interface {
+	UID
+	New() string
+}
+
+// Upload configures the upload-to-data mode.
+// An authenticated user uploads a JSON (.json), YAML (.yaml, .yml) or form-encoded (.form) file
+// to /<template id>/<ttl>.<format>, the file is decoded and stored to the WritableDataStorage under the generated uid.
+// <ttl> is a duration like 24h, any other file name means the storage's default ttl.
+// The generated uid and the file path are returned in the 226 reply to STOR like "OK, uid <uid> link <path>",
+// they are also returned as a content of the uploaded file when the client retrieves it back in the same session.
+// The upload path and the returned link follow the DefaultRouter layout, the Router only maps the paths
+// to the routes and can't build them back, so the links may not resolve with a custom Router
+type Upload struct {
+	Auth    core.Auth //authenticates users allowed to upload, other users are checked with the DriverFactory.Auth instead of the ServerOpts.Auth
+	MaxSize int64     //max uploaded file size, DefaultUploadMaxSize is used if 0
+	Ext     string    //extension of the file path returned to the client, "html" is used if empty
+}
+
+//uploadDriver is a Driver of the sessions with the uploads enabled, it implements goftp Auth interface.
+//goftp prefers the driver's Auth to the ServerOpts.Auth, so the plain Driver doesn't implement it
+type uploadDriver struct {
+	*Driver
+}
+
+// CheckPasswd implements goftp Auth interface, the upload users are checked first, then the DriverFactory.Auth ones
+func (d uploadDriver) CheckPasswd(login string, pass string) (bool, error) {
+	d.writable = false
+	if d.upload.Auth != nil {
+		ok, err := d.upload.Auth.CheckPasswd(login, pass)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			d.writable = true
+			return true, nil
+		}
+	}
+	return d.auth.CheckPasswd(login, pass)
+}
+
+// PutFile decodes the uploaded file and stores it to the data storage if the session is allowed to upload
+func (d *Driver) PutFile(filename string, r io.Reader, appendData bool) (int64, error) {
+	n, _, err := d.PutFileReply(filename, r, appendData)
+	return n, err
+}
+
+// PutFileReply implements goftp ReplyDriver interface, it stores the uploaded file like PutFile
+// and returns the reply message with the generated uid and the file path
+func (d *Driver) PutFileReply(filename string, r io.Reader, appendData bool) (int64, string, error) {
+	if !d.writable || appendData {
+		return 0, "", ERR_UPLOAD_DENIED
+	}
+
+	ws, ok := d.ps.(WritableDataStorage)
+	if !ok {
+		return 0, "", ERR_NOT_SUPPORTED
+	}
+	generator, ok := d.uidGenerator.(UIDGenerator)
+	if !ok {
+		return 0, "", ERR_NOT_SUPPORTED
+	}
+
+	templateId := strings.Trim(path.Dir(filename), "/")
+	if _, err := d.ts.Template(templateId); err != nil {
+		d.logger.Printf("%sWARN PUT %s %v", LOG_PREFIX, filename, err)
+		return 0, "", err
+	}
+
+	maxSize := d.upload.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultUploadMaxSize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return 0, "", err
+	}
+	if int64(len(body)) > maxSize {
+		return 0, "", ERR_UPLOAD_TOO_LARGE
+	}
+
+	base := path.Base(filename)
+	ext := path.Ext(base)
+	payload, err := decodeUpload(strings.TrimPrefix(ext, "."), body)
+	if err != nil {
+		d.logger.Printf("%sWARN PUT %s %v", LOG_PREFIX, filename, err)
+		return 0, "", err
+	}
+
+	var ttl *time.Duration
+	if v, err := time.ParseDuration(strings.TrimSuffix(base, ext)); err == nil && v > 0 {
+		ttl = &v
+	}
+
+	uid := generator.New()
+	if err := ws.Put(uid, payload, ttl); err != nil {
+		return 0, "", err
+	}
+
+	linkExt := d.upload.Ext
+	if linkExt == "" {
+		linkExt = "html"
+	}
+	link := path.Join("/", templateId, uid+"."+linkExt)
+	d.receipts[filename] = []byte(uid + "\r\n" + link + "\r\n")
+
+	d.logger.Printf("%sPUT %s %s%s", LOG_PREFIX, filename, link, d.client())
+	return int64(len(body)), fmt.Sprintf("OK, uid %s link %s", uid, link), nil
+}
+
+//decodeUpload decodes the uploaded file body to the payload according to the file format
+func decodeUpload(format string, body []byte) (map[string]interface{}, error) {
+	payload := map[string]interface{}{}
+	switch strings.ToLower(format) {
+	case "json":
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+	case "yaml", "yml":
+		if err := yaml.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+	case "form":
+		values, err := url.ParseQuery(strings.TrimSpace(string(body)))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range values {
+			if len(v) == 1 {
+				payload[k] = v[0]
+			} else {
+				payload[k] = v
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%v: %s", ERR_UPLOAD_FORMAT, format)
+	}
+	return payload, nil
+}
@@ -0,0 +1,42 @@
+package ftp
+
+import (
+	"github.com/starshiptroopers/ftpdt/goftp/core"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestUploadAuth(t *testing.T) {
+	factory := NewDriverFactory(listingTemplates{}, listingData{}, anyUID{}, log.New(ioutil.Discard, "", 0))
+
+	//goftp prefers the driver's Auth to the ServerOpts.Auth, so the driver mustn't override it without uploads
+	d, _ := factory.NewDriver()
+	if _, ok := d.(core.Auth); ok {
+		t.Errorf("Driver without uploads implements Auth and overrides the ServerOpts.Auth")
+	}
+
+	factory.Upload = &Upload{Auth: &core.SimpleAuth{Name: "writer", Password: "secret"}}
+	factory.Auth = &core.SimpleAuth{Name: "reader", Password: "secret"}
+	d, _ = factory.NewDriver()
+	auth, ok := d.(core.Auth)
+	if !ok {
+		t.Fatalf("Driver with uploads doesn't implement Auth")
+	}
+
+	tests := []struct {
+		login    string
+		success  bool
+		writable bool
+	}{
+		{"writer", true, true},
+		{"reader", true, false},
+		{"anonymous", false, false},
+	}
+	for _, test := range tests {
+		success, err := auth.CheckPasswd(test.login, "secret")
+		if err != nil || success != test.success || d.(uploadDriver).writable != test.writable {
+			t.Errorf("%s: wrong auth result %v, writable %v, %v", test.login, success, d.(uploadDriver).writable, err)
+		}
+	}
+}
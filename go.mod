@@ -1,11 +1,29 @@
 module github.com/starshiptroopers/ftpdt
 
-go 1.13
+go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.0
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/astaxie/beego v1.12.3
+	github.com/gomodule/redigo v1.8.9
+	github.com/hashicorp/golang-lru v0.5.4
 	github.com/jlaffaye/ftp v0.0.0-20190624084859-c1312a7102bf
-	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2
+	github.com/mattn/go-sqlite3 v1.14.19 // the cgo driver is used by the datastorage tests only, the library doesn't import it
 	github.com/starshiptroopers/uidgenerator v0.0.3
-	goftp.io/server v0.4.0
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/yuin/gopher-lua v0.0.0-20220504180219-658193537a64 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
+
+//the retracted versions required by beego
+exclude (
+	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 )
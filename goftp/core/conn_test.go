@@ -0,0 +1,126 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnBuildPath(t *testing.T) {
+	c := &Conn{
+		curDir: "",
+	}
+	var pathtests = []struct {
+		in  string
+		out string
+	}{
+		{"/", "/"},
+		{"one.txt", "/one.txt"},
+		{"/files/two.txt", "/files/two.txt"},
+		{"files/two.txt", "/files/two.txt"},
+		{"/../../../../etc/passwd", "/etc/passwd"},
+		{"rclone-test-roxarey8facabob5tuwetet4/hello? sausage/êé/Hello, 世界/ \" ' @ < > & ? + ≠/z.txt", "/rclone-test-roxarey8facabob5tuwetet4/hello? sausage/êé/Hello, 世界/ \" ' @ < > & ? + ≠/z.txt"},
+	}
+	for _, tt := range pathtests {
+		t.Run(tt.in, func(t *testing.T) {
+			s := c.buildPath(tt.in)
+			if s != tt.out {
+				t.Errorf("got %q, want %q", s, tt.out)
+			}
+		})
+	}
+}
+
+type mockConn struct {
+	ip   net.IP
+	port int
+}
+
+func (m mockConn) Read(b []byte) (n int, err error) {
+	return 0, nil
+}
+func (m mockConn) Write(b []byte) (n int, err error) {
+	return 0, nil
+}
+func (m mockConn) Close() error {
+	return nil
+}
+func (m mockConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{
+		IP:   m.ip,
+		Port: m.port,
+	}
+}
+func (m mockConn) RemoteAddr() net.Addr {
+	return nil
+}
+func (m mockConn) SetDeadline(t time.Time) error {
+	return nil
+}
+func (m mockConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (m mockConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+func TestPassiveListenIP(t *testing.T) {
+	c := &Conn{
+		server: &Server{
+			ServerOpts: &ServerOpts{
+				PublicIP: "1.1.1.1",
+			},
+		},
+	}
+	if c.passiveListenIP() != "1.1.1.1" {
+		t.Fatalf("Expected passive listen IP to be 1.1.1.1 but got %s", c.passiveListenIP())
+	}
+
+	c = &Conn{
+		conn: mockConn{
+			ip: net.IPv4(1, 1, 1, 1),
+		},
+		server: &Server{
+			ServerOpts: &ServerOpts{},
+		},
+	}
+	if c.passiveListenIP() != "1.1.1.1" {
+		t.Fatalf("Expected passive listen IP to be 1.1.1.1 but got %s", c.passiveListenIP())
+	}
+}
+
+func TestConnImplicitTLS(t *testing.T) {
+	for _, tt := range []struct {
+		opts ServerOpts
+		tls  bool
+	}{
+		{ServerOpts{}, false},
+		{ServerOpts{TLS: true, ExplicitFTPS: true}, false},
+		{ServerOpts{TLS: true}, true},
+	} {
+		c := NewServer(&tt.opts).newConn(nil, nil)
+		if c.tls != tt.tls {
+			t.Errorf("TLS %v, ExplicitFTPS %v: got session tls %v, want %v", tt.opts.TLS, tt.opts.ExplicitFTPS, c.tls, tt.tls)
+		}
+	}
+}
+
+type initDriver struct {
+	Driver
+	conn *Conn
+}
+
+func (d *initDriver) Init(conn *Conn) {
+	d.conn = conn
+}
+
+func TestConnDriverInit(t *testing.T) {
+	d := &initDriver{}
+	c := NewServer(&ServerOpts{}).newConn(nil, d)
+	if d.conn != c || c.SessionID() == "" {
+		t.Errorf("ConnDriver isn't initialized with the connection")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdt
+
+import (
+	"bytes"
+	"github.com/starshiptroopers/ftpdt/ftp"
+	"log"
+	"net/http"
+	"os"
+	"path"
+)
+
+// HTTPHandler serves the generated files over http.
+// The url path is mapped to the template and the data the same way as the ftp path,
+// so https://host/example/redirect/abcde.txt returns the same content as ftp://host/example/redirect/abcde.txt
+type HTTPHandler struct {
+	factory *ftp.DriverFactory
+	logger  *log.Logger
+}
+
+// NewHTTPHandler creates the HTTPHandler which produces files with the factory
+func NewHTTPHandler(factory *ftp.DriverFactory, logger *log.Logger) *HTTPHandler {
+	if factory == nil {
+		panic("DriverFactory isn't defined")
+	}
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &HTTPHandler{factory, logger}
+}
+
+// ServeHTTP implements http.Handler
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := path.Clean("/" + r.URL.Path)
+	body, modTime, err := h.factory.Produce(p)
+	if ftp.IsTemplateError(err) {
+		h.logger.Printf("%sERROR HTTP %s %v", ftp.LOG_PREFIX, p, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		h.logger.Printf("%sWARN HTTP %s %v", ftp.LOG_PREFIX, p, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	h.logger.Printf("%sHTTP GET %s", ftp.LOG_PREFIX, p)
+	http.ServeContent(w, r, path.Base(p), modTime, bytes.NewReader(body))
+}
+
+// HTTPHandler returns the http.Handler serving the same files as the ftp server.
+// It panics if the server is created with a custom ftp driver factory
+func (ftpdt *Ftpdt) HTTPHandler() http.Handler {
+	if ftpdt.factory == nil {
+		panic("HTTPHandler requires the ftpdt DriverFactory")
+	}
+	return NewHTTPHandler(ftpdt.factory, ftpdt.log)
+}
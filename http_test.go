@@ -0,0 +1,52 @@
+package ftpdt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Requests the file over http and compares it with the one downloaded over ftp
+func TestHTTPHandler(t *testing.T) {
+	opts := &Opts{
+		TemplateStorage: NewDummyTemplateStorage(),
+		DataStorage:     NewDummyDataStorage(),
+		UidGenerator:    newUidGenerator(),
+	}
+	addr, stop := startServer(t, opts)
+	defer stop()
+
+	filename := "/" + opts.UidGenerator.New() + ".html"
+	downloaded, err := downloadFile(addr, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(New(opts).HTTPHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + filename)
+	if err != nil {
+		t.Fatalf("Can't get the file over http: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Wrong http status: %d", resp.StatusCode)
+	}
+	if !bytes.Equal(body, downloaded) {
+		t.Error("HTTP handler returns a different file content")
+	}
+
+	resp, err = http.Get(srv.URL + "/unknown/" + opts.UidGenerator.New() + ".html")
+	if err != nil {
+		t.Fatalf("Can't get the file over http: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("404 is expected for unknown template, got %d", resp.StatusCode)
+	}
+}
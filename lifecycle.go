@@ -0,0 +1,489 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/starshiptroopers/ftpdt/ftp"
+	"github.com/starshiptroopers/ftpdt/goftp/core"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrServerStarted = errors.New("server is already started")
+)
+
+//shutdownPollInterval is how often Shutdown checks whether the in-flight transfers are finished
+var shutdownPollInterval = time.Millisecond * 50
+
+// Start binds the ftp ports and serves the connections in the background, it returns once the ports are bound.
+// Cancelling the ctx stops the server the same way as Shutdown with an expired context does,
+// use Shutdown to stop it gracefully
+func (ftpdt *Ftpdt) Start(ctx context.Context) error {
+	return ftpdt.start(ctx, nil)
+}
+
+// Serve serves the ftp connections accepted by the caller-provided listener, e.g. inherited from systemd (see SystemdListeners).
+// It's blocking function like ListenAndServe, FtpOpts Hostname and Port are not used to listen then.
+// The passive data listeners are opened with FtpOpts.PassiveListener if it's set
+func (ftpdt *Ftpdt) Serve(l net.Listener) error {
+	if err := ftpdt.start(context.Background(), l); err != nil {
+		return err
+	}
+	<-ftpdt.done
+	return ftpdt.err
+}
+
+//start starts the server on the caller-provided listener or on the configured port if l is nil
+func (ftpdt *Ftpdt) start(ctx context.Context, l net.Listener) error {
+	ftpdt.mu.Lock()
+	if ftpdt.done != nil {
+		ftpdt.mu.Unlock()
+		return ErrServerStarted
+	}
+	ftpdt.done = make(chan struct{})
+	ftpdt.mu.Unlock()
+
+	l, il, err := ftpdt.bind(l)
+	if err != nil {
+		ftpdt.logger.Printf("", "server can't be started: %v", err)
+		ftpdt.err = err
+		close(ftpdt.done)
+		return err
+	}
+
+	ftpdt.logger.Printf("", "server has been started at %s", l.Addr())
+	if il != nil {
+		ftpdt.logger.Printf("", "implicit FTPS has been started at %s", il.Addr())
+	}
+	close(ftpdt.ready)
+
+	go func() {
+		ftpdt.err = ftpdt.run(l, il)
+		close(ftpdt.done)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = ftpdt.Shutdown(ctx)
+		case <-ftpdt.done:
+		}
+	}()
+	return nil
+}
+
+// Ready returns a channel which is closed once the ftp ports are bound and the server accepts the connections.
+// It's never closed if the server fails to start, Start and Serve return the error then, so wait for it together with them
+func (ftpdt *Ftpdt) Ready() <-chan struct{} {
+	return ftpdt.ready
+}
+
+// Shutdown stops accepting the connections, waits for the in-flight transfers to finish
+// closing the idle sessions, and force-closes the rest of the sessions when the ctx is done.
+// It returns the ctx error if the sessions have been force-closed
+func (ftpdt *Ftpdt) Shutdown(ctx context.Context) error {
+	ftpdt.mu.Lock()
+	ftpdt.closing = true
+	var err error
+	for _, l := range ftpdt.listeners {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+	ftpdt.listeners = nil
+	ftpdt.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !ftpdt.sessions.closeIdle() {
+		select {
+		case <-ctx.Done():
+			ftpdt.sessions.closeAll()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
+
+//bind prepares the templates and the certificates and opens the listeners of the plain and the implicit FTPS servers,
+//the caller-provided listener l is used by the plain server if it's not nil
+func (ftpdt *Ftpdt) bind(l net.Listener) (_ net.Listener, il net.Listener, err error) {
+	if ftpdt.opts.Precompile {
+		if err = ftpdt.opts.TemplateStorage.(ftp.TemplatePrecompiler).Precompile(); err != nil {
+			return
+		}
+	}
+
+	if ftpdt.certs != nil {
+		if err = ftpdt.certs.load(); err != nil {
+			return
+		}
+	} else if ftpdt.TLS && ftpdt.TLSConfig == nil {
+		//FtpOpts TLS, the certificate is loaded here, so the server isn't reported ready with a broken one
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(ftpdt.CertFile, ftpdt.KeyFile); err != nil {
+			return
+		}
+		ftpdt.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if l == nil {
+		l, err = ftpdt.listen(ftpdt.Server)
+	} else {
+		//the links in the request context refer to the port the listener is really bound to
+		if addr, ok := l.Addr().(*net.TCPAddr); ok && ftpdt.factory != nil {
+			ftpdt.factory.Port = addr.Port
+		}
+		l, err = ftpdt.track(ftpdt.Server, l)
+	}
+	if err != nil {
+		return
+	}
+
+	if ftpdt.implicit != nil {
+		if ftpdt.opts.TLS.ImplicitListener != nil {
+			il, err = ftpdt.track(ftpdt.implicit, ftpdt.opts.TLS.ImplicitListener)
+		} else {
+			il, err = ftpdt.listen(ftpdt.implicit)
+		}
+		if err != nil {
+			_ = l.Close()
+			return nil, nil, err
+		}
+	}
+	return l, il, nil
+}
+
+//run serves the listeners until Shutdown is called or any of them fails,
+//the implicit FTPS server is stopped together with the plain one
+func (ftpdt *Ftpdt) run(l net.Listener, il net.Listener) error {
+	if ftpdt.certs != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go ftpdt.certs.watch(stop)
+	}
+
+	implicitErr := make(chan error, 1)
+	if il != nil {
+		go func() {
+			err := ftpdt.serve(ftpdt.implicit, il)
+			implicitErr <- err
+			if err != core.ErrServerClosed {
+				_ = l.Close()
+			}
+		}()
+	}
+
+	err := ftpdt.serve(ftpdt.Server, l)
+	if il != nil {
+		select {
+		case ierr := <-implicitErr:
+			//the implicit server has failed first and closed the plain listener
+			if ierr != core.ErrServerClosed {
+				return ierr
+			}
+		default:
+			_ = il.Close()
+			<-implicitErr
+		}
+	}
+	return err
+}
+
+//listen starts listening on the server's port and tracks the listener
+func (ftpdt *Ftpdt) listen(server *core.Server) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(server.Hostname, strconv.Itoa(server.Port)))
+	if err != nil {
+		return nil, err
+	}
+	return ftpdt.track(server, l)
+}
+
+//track wraps the listener with the PROXY protocol if it's enabled, tracks its sessions
+//and binds the server's driver factory to it. goftp wraps it with TLS for the implicit FTPS itself,
+//so the PROXY header is read before the TLS handshake. The listener is closed on Shutdown
+func (ftpdt *Ftpdt) track(server *core.Server, l net.Listener) (net.Listener, error) {
+	if ftpdt.proxy != nil {
+		l = newProxyListener(l, ftpdt.proxy, ftpdt.opts.ProxyProtocol.HeaderTimeout)
+	}
+	l = ftpdt.sessions.listener(l)
+	if ftpdt.factory != nil {
+		l, server.Factory = ftpdt.factory.Listen(l)
+	}
+
+	ftpdt.mu.Lock()
+	defer ftpdt.mu.Unlock()
+	if ftpdt.closing {
+		_ = l.Close()
+		return nil, core.ErrServerClosed
+	}
+	ftpdt.listeners = append(ftpdt.listeners, l)
+	return l, nil
+}
+
+//serve serves the listener opened with listen, it returns core.ErrServerClosed once Shutdown is called
+func (ftpdt *Ftpdt) serve(server *core.Server, l net.Listener) error {
+	//goftp's Shutdown isn't safe to call concurrently with Serve, so ftpdt closes the listeners itself
+	err := server.Serve(l)
+	ftpdt.mu.Lock()
+	defer ftpdt.mu.Unlock()
+	if ftpdt.closing {
+		return core.ErrServerClosed
+	}
+	return err
+}
+
+//sessionTracker keeps the control connections, the passive data connections and the in-flight transfers of the sessions.
+//It's registered as goftp notifier to know when the transfers start and finish.
+//The sessions are told apart by the connections, the remote addresses are shared behind the PROXY protocol balancers
+type sessionTracker struct {
+	core.NullNotifier
+	maxPerIP int         //max sessions from one client ip, unlimited if 0
+	logger   *log.Logger //logs the refused sessions
+
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{} //control connections
+	ips   map[string]int            //number of the control connections by the client ip
+	data  map[*dataConn]struct{}    //passive data connections
+}
+
+func newSessionTracker(maxPerIP int, logger *log.Logger) *sessionTracker {
+	return &sessionTracker{
+		maxPerIP: maxPerIP,
+		logger:   logger,
+		conns:    map[*trackedConn]struct{}{},
+		ips:      map[string]int{},
+		data:     map[*dataConn]struct{}{},
+	}
+}
+
+//listener tracks the connections accepted by the listener
+func (t *sessionTracker) listener(l net.Listener) net.Listener {
+	return &trackedListener{Listener: l, tracker: t}
+}
+
+//closeIdle closes the sessions without in-flight transfers, it returns true if there are no sessions left
+func (t *sessionTracker) closeIdle() bool {
+	t.mu.Lock()
+	var idle []net.Conn
+	for c := range t.conns {
+		if c.transfers == 0 {
+			idle = append(idle, c)
+		}
+	}
+	left := len(t.conns) == len(idle)
+	t.mu.Unlock()
+
+	for _, c := range idle {
+		_ = c.Close()
+	}
+	return left
+}
+
+//closeAll closes all sessions aborting the in-flight passive transfers, the active mode transfers are finished by goftp.
+//Only the connections are closed, goftp sessions aren't safe to close concurrently with their own goroutines
+func (t *sessionTracker) closeAll() {
+	t.mu.Lock()
+	var conns []net.Conn
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	for c := range t.data {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+//passiveListener returns the goftp hook opening the passive data listeners with listen (on any address if it's nil),
+//the data connections accepted from them are tracked, so closeAll aborts the transfers
+func (t *sessionTracker) passiveListener(listen func(port int) (net.Listener, error)) func(port int) (net.Listener, error) {
+	return func(port int) (net.Listener, error) {
+		var l net.Listener
+		var err error
+		if listen != nil {
+			l, err = listen(port)
+		} else {
+			l, err = net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &dataListener{Listener: l, tracker: t}, nil
+	}
+}
+
+//tracked returns the tracked control connection of the goftp session, the implicit FTPS one is wrapped with TLS
+//and unwrapped with tls.Conn.NetConn (go 1.18)
+func tracked(conn net.Conn) *trackedConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tc, _ := conn.(*trackedConn)
+	return tc
+}
+
+func (t *sessionTracker) begin(conn *core.Conn) {
+	tc := tracked(conn.NetConn())
+	if tc == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc.transfers++
+}
+
+func (t *sessionTracker) end(conn *core.Conn) {
+	tc := tracked(conn.NetConn())
+	if tc == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tc.transfers--; tc.transfers < 0 {
+		tc.transfers = 0
+	}
+}
+
+//add tracks the connection, it returns false if there are too many sessions from the client ip
+func (t *sessionTracker) add(c *trackedConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.maxPerIP > 0 && t.ips[c.ip] >= t.maxPerIP {
+		return false
+	}
+	t.conns[c] = struct{}{}
+	t.ips[c.ip]++
+	return true
+}
+
+func (t *sessionTracker) remove(c *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+	if t.ips[c.ip]--; t.ips[c.ip] <= 0 {
+		delete(t.ips, c.ip)
+	}
+}
+
+// BeforeDownloadFile implements goftp Notifier
+func (t *sessionTracker) BeforeDownloadFile(conn *core.Conn, dstPath string) {
+	t.begin(conn)
+}
+
+// AfterFileDownloaded implements goftp Notifier
+func (t *sessionTracker) AfterFileDownloaded(conn *core.Conn, dstPath string, size int64, err error) {
+	t.end(conn)
+}
+
+// BeforePutFile implements goftp Notifier
+func (t *sessionTracker) BeforePutFile(conn *core.Conn, dstPath string) {
+	t.begin(conn)
+}
+
+// AfterFilePut implements goftp Notifier
+func (t *sessionTracker) AfterFilePut(conn *core.Conn, dstPath string, size int64, err error) {
+	t.end(conn)
+}
+
+//refusedReplyTimeout is how long the refused connection is given to take the reply
+var refusedReplyTimeout = time.Second
+
+type trackedListener struct {
+	net.Listener
+	tracker *sessionTracker
+}
+
+//Accept tracks the accepted connection, the connections from the client ips having too many sessions
+//are refused with 421 reply
+func (l *trackedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		//the real client address if the PROXY protocol is used
+		ip := c.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+
+		tc := &trackedConn{Conn: c, tracker: l.tracker, ip: ip}
+		if l.tracker.add(tc) {
+			return tc, nil
+		}
+
+		l.tracker.logger.Printf("%sWARN session from %s is refused, too many sessions", ftp.LOG_PREFIX, ip)
+		_ = c.SetWriteDeadline(time.Now().Add(refusedReplyTimeout))
+		_, _ = c.Write([]byte("421 Too many sessions from your address\r\n"))
+		_ = c.Close()
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker   *sessionTracker
+	ip        string
+	transfers int //number of in-flight transfers, guarded by the tracker's mu
+	once      sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.remove(c)
+	})
+	return c.Conn.Close()
+}
+
+//dataListener tracks the passive data connections
+type dataListener struct {
+	net.Listener
+	tracker *sessionTracker
+}
+
+func (l *dataListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	dc := &dataConn{Conn: c, tracker: l.tracker}
+	l.tracker.mu.Lock()
+	l.tracker.data[dc] = struct{}{}
+	l.tracker.mu.Unlock()
+	return dc, nil
+}
+
+//SetDeadline sets the accept deadline goftp uses to wait for the client if the listener supports it
+func (l *dataListener) SetDeadline(t time.Time) error {
+	if dl, ok := l.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+		return dl.SetDeadline(t)
+	}
+	return nil
+}
+
+type dataConn struct {
+	net.Conn
+	tracker *sessionTracker
+	once    sync.Once
+}
+
+func (c *dataConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.mu.Lock()
+		delete(c.tracker.data, c)
+		c.tracker.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
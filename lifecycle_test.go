@@ -0,0 +1,233 @@
+package ftpdt
+
+import (
+	"context"
+	"crypto/tls"
+	jftp "github.com/jlaffaye/ftp"
+	"github.com/starshiptroopers/ftpdt/datastorage"
+	"github.com/starshiptroopers/ftpdt/ftp"
+	"github.com/starshiptroopers/ftpdt/goftp/core"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func newLifecycleServer(t *testing.T) (*Ftpdt, net.Listener) {
+	ftpd := New(&Opts{
+		FtpOpts:         &core.ServerOpts{Hostname: "127.0.0.1"},
+		TemplateStorage: NewDummyTemplateStorage(),
+		DataStorage:     NewDummyDataStorage(),
+		UidGenerator:    newUidGenerator(),
+	})
+	return ftpd, listenLocal(t)
+}
+
+// Shutdown closes the idle sessions and the listener, the server can't be started twice
+func TestShutdown(t *testing.T) {
+	ftpd, l := newLifecycleServer(t)
+	addr := l.Addr().String()
+	go func() { _ = ftpd.Serve(l) }()
+	select {
+	case <-ftpd.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("Server isn't ready")
+	}
+	if err := ftpd.Start(context.Background()); err != ErrServerStarted {
+		t.Errorf("Server is started twice: %v", err)
+	}
+
+	c, err := jftp.Dial(addr, jftp.DialWithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("Can't login ftp server as anonymous: %v", err)
+	}
+	r, err := c.Retr("/" + newUidGenerator().New() + ".html")
+	if err != nil {
+		t.Fatalf("Can't open the remote file for download: %v", err)
+	}
+	_, _ = ioutil.ReadAll(r)
+	_ = r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ftpd.Shutdown(ctx); err != nil {
+		t.Fatalf("Server isn't gracefully stopped: %v", err)
+	}
+
+	select {
+	case <-ftpd.done:
+	case <-time.After(time.Second):
+		t.Fatal("Server didn't stop after waiting timeout")
+	}
+	if ftpd.err != core.ErrServerClosed {
+		t.Errorf("Wrong serving error %v", ftpd.err)
+	}
+	if err := c.NoOp(); err == nil {
+		t.Error("Idle session isn't closed on shutdown")
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		_ = conn.Close()
+		t.Error("Server accepts the connections after shutdown")
+	}
+}
+
+// Cancelling the Start context stops the server
+func TestStartContext(t *testing.T) {
+	ftpd, l := newLifecycleServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := ftpd.start(ctx, l); err != nil {
+		t.Fatalf("Can't start ftp server: %v", err)
+	}
+
+	c, err := jftp.Dial(l.Addr().String(), jftp.DialWithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	cancel()
+
+	select {
+	case <-ftpd.done:
+	case <-time.After(time.Second):
+		t.Fatal("Server didn't stop after the context is cancelled")
+	}
+	time.Sleep(shutdownPollInterval * 2)
+	if err := c.NoOp(); err == nil {
+		t.Error("Session isn't closed after the context is cancelled")
+	}
+}
+
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func (l pipeListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+func (l pipeListener) Close() error   { return nil }
+func (l pipeListener) Addr() net.Addr { return nil }
+
+// The sessions sharing the remote address are told apart, the TLS wrapped ones are found too
+func TestSessionTracker(t *testing.T) {
+	tracker := newSessionTracker(0, log.New(ioutil.Discard, "", 0))
+	pl := pipeListener{make(chan net.Conn, 2)}
+	l := tracker.listener(pl)
+
+	var clients []net.Conn
+	var conns []*trackedConn
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		pl.conns <- server
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+		conns = append(conns, c.(*trackedConn))
+	}
+	if conns[0].RemoteAddr().String() != conns[1].RemoteAddr().String() {
+		t.Fatal("Pipes are expected to share the remote address")
+	}
+	if tracked(tls.Server(conns[0], &tls.Config{})) != conns[0] {
+		t.Error("TLS wrapped connection isn't found")
+	}
+
+	//the first session has an in-flight transfer, so only the second one is idle
+	tracker.mu.Lock()
+	conns[0].transfers++
+	tracker.mu.Unlock()
+	if tracker.closeIdle() {
+		t.Error("Session with the in-flight transfer is closed")
+	}
+	if _, err := clients[1].Write([]byte("x")); err == nil {
+		t.Error("Idle session isn't closed")
+	}
+	tracker.mu.Lock()
+	_, busy := tracker.conns[conns[0]]
+	tracker.mu.Unlock()
+	if !busy {
+		t.Error("Session with the in-flight transfer is dropped from the tracker")
+	}
+}
+
+// Shutdown waits for the in-flight transfer to finish
+func TestShutdownTransfer(t *testing.T) {
+	ftpd := New(&Opts{
+		FtpOpts:         &core.ServerOpts{Hostname: "127.0.0.1"},
+		TemplateStorage: NewDummyTemplateStorage(),
+		DataStorage:     datastorage.NewMemoryDataStorage(),
+		UidGenerator:    newUidGenerator(),
+		Upload:          &ftp.Upload{Auth: &core.SimpleAuth{Name: "writer", Password: "secret"}},
+	})
+	l := listenLocal(t)
+	go func() { _ = ftpd.Serve(l) }()
+	<-ftpd.Ready()
+
+	c, err := jftp.Dial(l.Addr().String(), jftp.DialWithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	if err = c.Login("writer", "secret"); err != nil {
+		t.Fatalf("Can't login ftp server as writer: %v", err)
+	}
+
+	//the upload is in flight until the body is written
+	body, w := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() { uploaded <- c.Stor("/24h.json", body) }()
+	if _, err = w.Write([]byte(`{"Title": `)); err != nil {
+		t.Fatalf("Can't start the upload: %v", err)
+	}
+	//goftp notifies about the transfer right after the 150 reply
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		ftpd.sessions.mu.Lock()
+		inFlight := 0
+		for c := range ftpd.sessions.conns {
+			inFlight += c.transfers
+		}
+		ftpd.sessions.mu.Unlock()
+		if inFlight > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Upload isn't tracked")
+		}
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		stopped <- ftpd.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("Shutdown doesn't wait for the in-flight transfer: %v", err)
+	case <-time.After(shutdownPollInterval * 4):
+	}
+
+	_, _ = w.Write([]byte(`"Uploaded"}`))
+	_ = w.Close()
+	if err := <-uploaded; err != nil {
+		t.Errorf("In-flight upload is aborted: %v", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Server isn't gracefully stopped: %v", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("Shutdown doesn't return after the transfer is finished")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrProxyHeader = errors.New("wrong PROXY protocol header")
+
+	DefaultProxyHeaderTimeout = time.Second * 5
+)
+
+//proxyV2Signature starts the binary PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyOpts is a PROXY protocol (v1 and v2) options used behind HAProxy, cloud network load balancers and so on.
+// The connections from the trusted sources must start with the PROXY header carrying the real client address,
+// the sessions, the logs, the templates and Opts.MaxSessionsPerIP see that address then. The connections from other sources are served as is.
+// The passive data connections aren't proxied, they keep using PublicIP or the local address of the control connection
+type ProxyOpts struct {
+	TrustedCIDRs  []string      //balancers allowed to send the PROXY header, a single ip is allowed too
+	HeaderTimeout time.Duration //how long to wait for the PROXY header, DefaultProxyHeaderTimeout is used if 0
+}
+
+//parseCIDRs parses the trusted sources, single ips are converted to /32 or /128 networks
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("wrong trusted ip %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+//proxyListener reads the PROXY headers of the connections from the trusted sources.
+//The headers are read in the background, so a slow peer doesn't block goftp which accepts the connections one by one
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+
+	conns chan net.Conn
+	done  chan struct{} //closed when the underlying listener fails
+	err   error         //the accept error, valid after done is closed
+}
+
+func newProxyListener(l net.Listener, trusted []*net.IPNet, timeout time.Duration) *proxyListener {
+	if timeout == 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	pl := &proxyListener{
+		Listener: l,
+		trusted:  trusted,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go pl.serve()
+	return pl
+}
+
+func (l *proxyListener) serve() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(time.Millisecond * 5)
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.handshake(c)
+	}
+}
+
+//handshake reads the PROXY header if the connection is from the trusted source and passes the connection to Accept,
+//the connections with the broken or missing header are closed
+func (l *proxyListener) handshake(c net.Conn) {
+	if l.isTrusted(c.RemoteAddr()) {
+		_ = c.SetReadDeadline(time.Now().Add(l.timeout))
+		r := bufio.NewReader(c)
+		remote, err := readProxyHeader(r)
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+		_ = c.SetReadDeadline(time.Time{})
+		if remote == nil {
+			remote = c.RemoteAddr()
+		}
+		c = &proxyConn{Conn: c, r: r, remote: remote}
+	}
+
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		_ = c.Close()
+	}
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept implements net.Listener
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+//proxyConn is a connection with the client address taken from the PROXY header,
+//the local address is kept, so goftp advertises the right passive address
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader //holds the data the client sent right after the header
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+//readProxyHeader reads the PROXY protocol v1 or v2 header,
+//it returns nil address if the header doesn't carry the client address (UNKNOWN and LOCAL ones)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	//the shortest v1 header "PROXY UNKNOWN\r\n" is longer than the v2 signature
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, ErrProxyHeader
+}
+
+//readProxyV1 reads the text header, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 21\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	//the v1 header is 107 bytes at most
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+//readProxyV2 reads the binary header, the TLVs are skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrProxyHeader, header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+	}
+
+	//LOCAL command is sent by the balancer itself, e.g. health checks
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: //TCP over IPv4
+		if len(body) < 12 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: //TCP over IPv6
+		if len(body) < 36 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
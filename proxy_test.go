@@ -0,0 +1,177 @@
+package ftpdt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	jftp "github.com/jlaffaye/ftp"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(command byte, family byte, addr []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addr)))
+	return append(header, addr...)
+}
+
+func TestProxyHeader(t *testing.T) {
+	v4 := append(append(net.ParseIP("192.0.2.1").To4(), 198, 51, 100, 1), 0xdc, 0x04, 0, 21)
+	v6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0xdc, 0x04, 0, 21)
+
+	for _, test := range []struct {
+		name   string
+		header []byte
+		addr   string //empty if the original address is kept
+		err    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 21\r\n"), "192.0.2.1:56324", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 21\r\n"), "[2001:db8::1]:56324", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 broken", []byte("PROXY TCP4 192.0.2.1\r\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", true},
+		{"v2 tcp4", proxyV2Header(1, 0x11, v4), "192.0.2.1:56324", false},
+		{"v2 tcp6", proxyV2Header(1, 0x21, v6), "[2001:db8::1]:56324", false},
+		{"v2 tlvs", proxyV2Header(1, 0x11, append(v4, 0x04, 0, 1, 0)), "192.0.2.1:56324", false},
+		{"v2 local", proxyV2Header(0, 0x00, nil), "", false},
+		{"v2 short", proxyV2Header(1, 0x11, v4[:6]), "", true},
+		{"no header", []byte("USER anonymous\r\n"), "", true},
+	} {
+		r := bufio.NewReader(bytes.NewReader(append(test.header, "USER anonymous\r\n"...)))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if (addr == nil && test.addr != "") || (addr != nil && addr.String() != test.addr) {
+			t.Errorf("%s: wrong address %v, %s is expected", test.name, addr, test.addr)
+		}
+		if rest, _ := r.ReadString('\n'); rest != "USER anonymous\r\n" {
+			t.Errorf("%s: the data after the header is broken %q", test.name, rest)
+		}
+	}
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.String()
+}
+
+// The client address is taken from the PROXY header, the passive mode keeps working
+func TestProxyProtocol(t *testing.T) {
+	uidGenerator := newUidGenerator()
+	uid := uidGenerator.New()
+	logs := &syncBuffer{}
+
+	addr, stop := startServer(t, &Opts{
+		TemplateStorage: contextTemplateStorage{},
+		DataStorage:     NewDummyDataStorage(),
+		UidGenerator:    uidGenerator,
+		RequestContext:  true,
+		ProxyProtocol:   &ProxyOpts{TrustedCIDRs: []string{"10.0.0.0/8", "127.0.0.1"}, HeaderTimeout: time.Millisecond * 200},
+		LogWriter:       logs,
+	})
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	if _, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 21\r\n")); err != nil {
+		t.Fatalf("Can't send the PROXY header: %v", err)
+	}
+
+	//PASV advertises the address of the control connection
+	c, err := jftp.Dial(addr, jftp.DialWithNetConn(conn), jftp.DialWithDisabledEPSV(true), jftp.DialWithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	defer func() { _ = c.Quit() }()
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("Can't login ftp server as anonymous: %v", err)
+	}
+	r, err := c.Retr("/" + uid + ".html")
+	if err != nil {
+		t.Fatalf("Can't open the remote file for download: %v", err)
+	}
+	body, _ := ioutil.ReadAll(r)
+	_ = r.Close()
+
+	if !strings.HasPrefix(string(body), "192.0.2.1 html Title") {
+		t.Errorf("Client address isn't taken from the PROXY header: %s", body)
+	}
+	if !strings.Contains(logs.String(), "GET /"+uid+".html from 192.0.2.1") {
+		t.Errorf("Client address isn't logged: %s", logs.String())
+	}
+
+	//the trusted source must send the header
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	defer func() { _ = raw.Close() }()
+	_, _ = raw.Write([]byte("USER x\r\n"))
+	_ = raw.SetReadDeadline(time.Now().Add(time.Second))
+	if reply, err := ioutil.ReadAll(raw); err != nil || len(reply) != 0 {
+		t.Errorf("Connection without the PROXY header isn't closed: %q, %v", reply, err)
+	}
+}
+
+// The sessions are limited by the real client address taken from the PROXY header
+func TestMaxSessionsPerIP(t *testing.T) {
+	addr, stop := startServer(t, &Opts{
+		TemplateStorage:  NewDummyTemplateStorage(),
+		DataStorage:      NewDummyDataStorage(),
+		UidGenerator:     newUidGenerator(),
+		ProxyProtocol:    &ProxyOpts{TrustedCIDRs: []string{"127.0.0.1"}},
+		MaxSessionsPerIP: 1,
+		LogWriter:        ioutil.Discard,
+	})
+	defer stop()
+
+	greeting := func(client string) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Can't connect ftp server: %v", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		if _, err = conn.Write([]byte("PROXY TCP4 " + client + " 127.0.0.1 56324 21\r\n")); err != nil {
+			t.Fatalf("Can't send the PROXY header: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		reply := make([]byte, 3)
+		_, _ = io.ReadFull(conn, reply)
+		return string(reply)
+	}
+
+	if reply := greeting("192.0.2.1"); reply != "220" {
+		t.Errorf("First session is refused: %s", reply)
+	}
+	if reply := greeting("192.0.2.1"); reply != "421" {
+		t.Errorf("Session over the limit isn't refused: %s", reply)
+	}
+	if reply := greeting("192.0.2.2"); reply != "220" {
+		t.Errorf("Session from another client is refused: %s", reply)
+	}
+}
@@ -14,6 +14,7 @@
 // The requested ftp file is mapping to the template by its full path excluding the filename itself.
 // Then template is executed and filled with data and exposed to the ftp client as a regular file.
 // For example, if user download the file ftp://servername/example/redirect/abcde.txt, example/redirect.tmpl will be used as a template
+// (or example/redirect.txt.tmpl if it exists, so the same record can be rendered as abcde.html, abcde.txt and so on)
 // and the filename "abcde" is a UID used to invoke data from DataStorage and insert them to the template.
 //
 // ftpdt/datastorage implements a Data storage where data are stored in the memory and invoked by ftpdt request
@@ -21,27 +22,57 @@
 package ftpdt
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"github.com/starshiptroopers/ftpdt/ftp"
+	"github.com/starshiptroopers/ftpdt/goftp/core"
 	"github.com/starshiptroopers/uidgenerator"
-	"goftp.io/server/core"
 	"io"
 	"log"
+	"net"
 	"os"
+	"sync"
 )
 
 type Ftpdt struct {
 	*core.Server
-	logger core.Logger
+	logger   core.Logger
+	log      *log.Logger
+	opts     *Opts
+	factory  *ftp.DriverFactory //nil if the custom driver factory is used
+	certs    *certStore         //nil if TLS isn't enabled with Opts.TLS
+	implicit *core.Server       //implicit FTPS server sharing the driver factory, nil if it isn't enabled
+
+	sessions *sessionTracker
+	proxy    []*net.IPNet //trusted PROXY protocol sources, nil if the PROXY protocol isn't enabled
+
+	mu        sync.Mutex
+	listeners []net.Listener //listeners opened by ftpdt itself, closed on Shutdown
+	closing   bool
+	ready     chan struct{} //closed once the listeners are bound
+	done      chan struct{} //closed once the server is stopped, nil if it isn't started
+	err       error         //the serving error, valid after done is closed
 }
 
 // Opts is a ftpdt options
 type Opts struct {
-	FtpOpts         *core.ServerOpts    //goftp server options
-	UidGenerator    uidgenerator.UID    //uid validator used to invoke and validate uids from the ftp filepath
-	TemplateStorage ftp.TemplateStorage //template storage used to invoke templates
-	DataStorage     ftp.DataStorage     //data storage
-	LogFtpDebug     bool                //do a verbose ftp operations logging
-	LogWriter       io.Writer           //Where log will be written to (default to stdout)
+	FtpOpts          *core.ServerOpts       //goftp server options
+	TLS              *TLSOpts               //enables explicit FTPS, FtpOpts TLS settings are ignored if it's set
+	UidGenerator     uidgenerator.UID       //uid validator used to invoke and validate uids from the ftp filepath
+	TemplateStorage  ftp.TemplateStorage    //template storage used to invoke templates
+	DataStorage      ftp.DataStorage        //data storage
+	Router           ftp.Router             //maps the ftp path to the template and the data, ftp.DefaultRouter is used if nil
+	Listing          *ftp.Listing           //enables directory listings (LIST, NLST and MLSD), they return an error if nil
+	Upload           *ftp.Upload            //enables uploading the records to the DataStorage, it must implement ftp.WritableDataStorage, the links follow the ftp.DefaultRouter layout
+	FuncMap          map[string]interface{} //custom template functions, the TemplateStorage must implement ftp.TemplateFuncs
+	DefaultData      map[string]interface{} //site-wide data merged into every record's payload, see ftp.DriverFactory.SetDefaultData
+	RequestContext   bool                   //pass ftp.RequestContext wrapping the payload to the templates instead of the raw payload
+	Precompile       bool                   //parse all templates on start and refuse to start if any is broken, the TemplateStorage must implement ftp.TemplatePrecompiler
+	ProxyProtocol    *ProxyOpts             //read the real client addresses from the PROXY protocol headers sent by the trusted balancers
+	MaxSessionsPerIP int                    //refuse the sessions from the client ip having so many sessions already (the real one behind the PROXY protocol), unlimited if 0
+	LogFtpDebug      bool                   //do a verbose ftp operations logging
+	LogWriter        io.Writer              //Where log will be written to (default to stdout)
 }
 
 //Create a new Ftpdt instanse
@@ -58,6 +89,37 @@ func New(opts *Opts) (server *Ftpdt) {
 		panic("DataStorage isn't defined")
 	}
 
+	if opts.Upload != nil {
+		if _, ok := opts.DataStorage.(ftp.WritableDataStorage); !ok {
+			panic("DataStorage isn't writable, uploads can't be enabled")
+		}
+	}
+
+	if opts.FuncMap != nil {
+		ts, ok := opts.TemplateStorage.(ftp.TemplateFuncs)
+		if !ok {
+			panic("TemplateStorage doesn't support custom template functions")
+		}
+		ts.Funcs(opts.FuncMap)
+	}
+
+	if opts.Precompile {
+		if _, ok := opts.TemplateStorage.(ftp.TemplatePrecompiler); !ok {
+			panic("TemplateStorage can't precompile the templates")
+		}
+	}
+
+	var proxy []*net.IPNet
+	if opts.ProxyProtocol != nil {
+		var err error
+		if proxy, err = parseCIDRs(opts.ProxyProtocol.TrustedCIDRs); err != nil {
+			panic(fmt.Sprintf("ProxyProtocol trusted CIDRs are wrong: %v", err))
+		}
+		if len(proxy) == 0 {
+			panic("ProxyProtocol trusted CIDRs aren't defined")
+		}
+	}
+
 	if opts.LogWriter == nil {
 		opts.LogWriter = os.Stdout
 	}
@@ -69,6 +131,7 @@ func New(opts *Opts) (server *Ftpdt) {
 	}
 
 	logger := ftp.NewDefaultFTPLogger(opts.LogWriter)
+	l := log.New(opts.LogWriter, "", log.LstdFlags)
 
 	if ftpCfg.Logger == nil {
 		if opts.LogFtpDebug {
@@ -78,21 +141,80 @@ func New(opts *Opts) (server *Ftpdt) {
 		}
 	}
 
+	var certs *certStore
+	if opts.TLS != nil {
+		certs = newCertStore(*opts.TLS, l)
+		ftpCfg.TLS = true
+		ftpCfg.ExplicitFTPS = true
+		ftpCfg.ForceTLS = opts.TLS.RequireTLS
+		ftpCfg.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+
+	var factory *ftp.DriverFactory
 	if ftpCfg.Factory == nil {
-		ftpCfg.Factory = ftp.NewDriverFactory(
+		factory = ftp.NewDriverFactory(
 			opts.TemplateStorage,
 			opts.DataStorage,
 			opts.UidGenerator,
-			log.New(opts.LogWriter, "", log.LstdFlags),
+			l,
 		)
+		if opts.Router != nil {
+			factory.Router = opts.Router
+		}
+		factory.Listing = opts.Listing
+		factory.Auth = ftpCfg.Auth
+		factory.Upload = opts.Upload
+		factory.RequestContext = opts.RequestContext
+		factory.SetDefaultData(opts.DefaultData)
+		ftpCfg.Factory = factory
 	}
 
-	server = &Ftpdt{core.NewServer(&ftpCfg), logger}
+	//the passive data connections are tracked to abort them when Shutdown's context is done
+	sessions := newSessionTracker(opts.MaxSessionsPerIP, l)
+	ftpCfg.PassiveListener = sessions.passiveListener(ftpCfg.PassiveListener)
+
+	server = &Ftpdt{Server: core.NewServer(&ftpCfg), logger: logger, log: l, opts: opts, factory: factory, certs: certs}
+	server.sessions = sessions
+	server.proxy = proxy
+	server.ready = make(chan struct{})
+	server.RegisterNotifer(server.sessions)
+	if certs != nil && (opts.TLS.ImplicitPort != 0 || opts.TLS.ImplicitListener != nil) {
+		//goftp serves the implicit FTPS when TLS is used without ExplicitFTPS
+		implicitCfg := ftpCfg
+		implicitCfg.Port = opts.TLS.ImplicitPort
+		implicitCfg.ExplicitFTPS = false
+		implicitCfg.ForceTLS = false
+		server.implicit = core.NewServer(&implicitCfg)
+		server.implicit.RegisterNotifer(server.sessions)
+	}
+	if factory != nil {
+		factory.Hostname = server.PublicIP
+		if factory.Hostname == "" {
+			factory.Hostname = server.Hostname
+		}
+		//the server listens on all the addresses, so the public hostname isn't known and the links aren't built
+		if ip := net.ParseIP(factory.Hostname); ip != nil && ip.IsUnspecified() {
+			factory.Hostname = ""
+		}
+		factory.Port = server.Port
+	}
 	return
 }
 
-//ListenAndServe starts listening for ftp connection. It's blocking function
+//SetDefaultData replaces the site-wide data merged into every record's payload, it allows to reload them at runtime.
+//It panics if the server is created with a custom ftp driver factory
+func (ftpdt *Ftpdt) SetDefaultData(data map[string]interface{}) {
+	if ftpdt.factory == nil {
+		panic("SetDefaultData requires the ftpdt DriverFactory")
+	}
+	ftpdt.factory.SetDefaultData(data)
+}
+
+//ListenAndServe starts listening for ftp connection. It's blocking function, it returns core.ErrServerClosed after Shutdown
 func (ftpdt *Ftpdt) ListenAndServe() error {
-	ftpdt.logger.Printf("", "server has been started at %s:%d", ftpdt.Hostname, ftpdt.Port)
-	return ftpdt.Server.ListenAndServe()
+	if err := ftpdt.Start(context.Background()); err != nil {
+		return err
+	}
+	<-ftpdt.done
+	return ftpdt.err
 }
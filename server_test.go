@@ -2,16 +2,23 @@ package ftpdt
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/jlaffaye/ftp"
-	"github.com/phayes/freeport"
+	jftp "github.com/jlaffaye/ftp"
+	"github.com/starshiptroopers/ftpdt/datastorage"
+	"github.com/starshiptroopers/ftpdt/ftp"
+	"github.com/starshiptroopers/ftpdt/goftp/core"
+	"github.com/starshiptroopers/ftpdt/tmplstorage"
 	"github.com/starshiptroopers/uidgenerator"
-	"goftp.io/server/core"
 	"html/template"
 	"io/ioutil"
+	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -40,7 +47,7 @@ func NewDummyTemplateStorage() *DummyTemplateStorage {
 
 }
 
-func (t *DummyTemplateStorage) Template(id string) (*template.Template, error) {
+func (t *DummyTemplateStorage) Template(id string) (ftp.Template, error) {
 
 	if id != "" {
 		return nil, errors.New("not found")
@@ -65,7 +72,7 @@ func (t *DummyTemplateStorage) Template(id string) (*template.Template, error) {
 
 // start ftp client connection and download the file from our ftpdt server
 func downloadFile(server string, path string) ([]byte, error) {
-	c, err := ftp.Dial(server, ftp.DialWithTimeout(time.Second))
+	c, err := jftp.Dial(server, jftp.DialWithTimeout(time.Second))
 	if err != nil {
 		return nil, fmt.Errorf("Can't connect ftp server: %v, ", err)
 	}
@@ -90,25 +97,77 @@ func downloadFile(server string, path string) ([]byte, error) {
 	return buf, nil
 }
 
-//
-// Creates ftpdt server with a testing template and data st
-// Starts ftp client and downloads the file from this ftpdt server
-// Compare the file content we got from ftpdt server  with the data we expect
-func TestServer(t *testing.T) {
+// start ftpdt server on a free port, returns the server address and the function which stops the server
+func startServer(t *testing.T, opts *Opts) (string, func()) {
+	l := listenLocal(t)
+	if opts.FtpOpts == nil {
+		opts.FtpOpts = &core.ServerOpts{}
+	}
+	opts.FtpOpts.Hostname = "127.0.0.1"
+	ftpd := New(opts)
+
+	closeCh := make(chan error)
+
+	go func() {
+		err := ftpd.Serve(l)
+		if err != nil {
+			if err != core.ErrServerClosed {
+				closeCh <- err
+			}
+		}
+		close(closeCh)
+	}()
 
-	port, err := freeport.GetFreePort()
+	//wait for server became ready
+	select {
+	case err := <-closeCh:
+		t.Fatalf("Can't start ftp server: %v", err)
+	case <-ftpd.Ready():
+	}
+
+	return l.Addr().String(), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := ftpd.Shutdown(ctx); err != nil {
+			t.Errorf("Server isn't gracefully stopped: %v", err)
+		}
+		//wait for server shutdown ready
+		select {
+		case <-closeCh:
+
+		case <-time.After(time.Second):
+			t.Fatal("Server didn't stop after waiting timeout")
+		}
+	}
+}
+
+// listen on a free local port
+func listenLocal(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatal("Can't get a free tcp port")
+		t.Fatalf("Can't listen on a free tcp port: %v", err)
 	}
-	host := "127.0.0.1"
-	path := ""
-	uidGenerator := uidgenerator.New(
+	return l
+}
+
+func newUidGenerator() *uidgenerator.UIDGenerator {
+	return uidgenerator.New(
 		&uidgenerator.Cfg{
 			Alfa:      "1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
 			Format:    "XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX",
 			Validator: "[0-9a-zA-Z]{32}",
 		},
 	)
+}
+
+//
+// Creates ftpdt server with a testing template and data st
+// Starts ftp client and downloads the file from this ftpdt server
+// Compare the file content we got from ftpdt server  with the data we expect
+func TestServer(t *testing.T) {
+
+	path := ""
+	uidGenerator := newUidGenerator()
 	uid := uidGenerator.New()
 	filename := path + uid + ".html"
 
@@ -129,53 +188,265 @@ func TestServer(t *testing.T) {
 	}
 	generated := buff.Bytes()
 
-	configuration := &Opts{
-		FtpOpts:         &core.ServerOpts{Port: port, Hostname: host},
+	addr, stop := startServer(t, &Opts{
 		TemplateStorage: tStorage,
 		DataStorage:     dStorage,
 		UidGenerator:    uidGenerator,
 		LogFtpDebug:     true,
+	})
+	defer stop()
+
+	downloaded, err := downloadFile(addr, filename)
+
+	if err != nil {
+		t.Fatal(err)
 	}
-	ftpd := New(configuration)
 
-	closeCh := make(chan error)
+	if !bytes.Equal(downloaded, generated) {
+		t.Fatal("FTP server returns a wrong file content")
+		return
+	}
+}
 
-	go func() {
-		err = ftpd.ListenAndServe()
-		if err != nil {
-			closeCh <- err
-		}
-		close(closeCh)
-	}()
+// Uploads a record with the upload user, downloads the receipt and then the generated file
+func TestUpload(t *testing.T) {
+	addr, stop := startServer(t, &Opts{
+		TemplateStorage: NewDummyTemplateStorage(),
+		DataStorage:     datastorage.NewMemoryDataStorage(),
+		UidGenerator:    newUidGenerator(),
+		Upload:          &ftp.Upload{Auth: &core.SimpleAuth{Name: "writer", Password: "secret"}},
+	})
+	defer stop()
+
+	c, err := jftp.Dial(addr, jftp.DialWithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	defer func() { _ = c.Quit() }()
 
-	//wait for server became ready
-	select {
-	case err := <-closeCh:
-		t.Fatalf("Can't start ftp server: %v", err)
-	//it's quite unreliable to use timeouts, but, it is simple and reasonable in this case
-	case <-time.After(time.Second):
+	body := `{"Title": "Uploaded", "Caption": "Caption", "Url": "https://starshiptroopers.dev"}`
 
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("Can't login ftp server as anonymous: %v", err)
+	}
+	if err = c.Stor("/24h.json", strings.NewReader(body)); err == nil {
+		t.Error("Anonymous user must not be allowed to upload")
 	}
 
-	defer func() {
-		_ = ftpd.Shutdown()
-		//wait for server shutdown ready
-		select {
-		case <-closeCh:
+	if err = c.Login("writer", "secret"); err != nil {
+		t.Fatalf("Can't login ftp server as writer: %v", err)
+	}
+	if err = c.Stor("/24h.json", strings.NewReader(body)); err != nil {
+		t.Fatalf("Can't upload the file: %v", err)
+	}
 
-		case <-time.After(time.Second):
-			t.Fatalf("Server didn't stop after waiting timeout: %v", err)
+	r, err := c.Retr("/24h.json")
+	if err != nil {
+		t.Fatalf("Can't download the upload receipt: %v", err)
+	}
+	receipt, _ := ioutil.ReadAll(r)
+	_ = r.Close()
+
+	lines := strings.Fields(string(receipt))
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], lines[0]+".html") {
+		t.Fatalf("Wrong upload receipt: %s", receipt)
+	}
+
+	downloaded, err := downloadFile(addr, lines[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(downloaded), "<title>Uploaded</title>") {
+		t.Errorf("Uploaded data isn't used in the generated file: %s", downloaded)
+	}
+}
+
+// Reads the generated uid and link from the STOR reply, jlaffaye client doesn't return it
+func TestUploadReply(t *testing.T) {
+	addr, stop := startServer(t, &Opts{
+		TemplateStorage: NewDummyTemplateStorage(),
+		DataStorage:     datastorage.NewMemoryDataStorage(),
+		UidGenerator:    newUidGenerator(),
+		Upload:          &ftp.Upload{Auth: &core.SimpleAuth{Name: "writer", Password: "secret"}},
+	})
+	defer stop()
+
+	//the FTPS client works over the plain connection until AUTH TLS
+	c, err := dialFTPS(addr)
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	defer func() { _ = c.conn.Close() }()
+	if _, err := c.cmd(331, "USER writer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.cmd(230, "PASS secret"); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := c.cmd(229, "EPSV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strings.Trim(msg[strings.Index(msg, "(")+1:strings.Index(msg, ")")], "|")
+	data, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), time.Second)
+	if err != nil {
+		t.Fatalf("Can't open the data connection: %v", err)
+	}
+	if _, err := c.cmd(150, "STOR /24h.json"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = data.Write([]byte(`{"Title": "Uploaded"}`))
+	_ = data.Close()
+
+	_, reply, err := c.text.ReadResponse(226)
+	if err != nil {
+		t.Fatalf("Can't upload the file: %v", err)
+	}
+	var uid, link string
+	if _, err := fmt.Sscanf(reply, "OK, uid %s link %s", &uid, &link); err != nil || link != "/"+uid+".html" {
+		t.Fatalf("Wrong upload reply %q", reply)
+	}
+
+	downloaded, err := downloadFile(addr, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(downloaded), "<title>Uploaded</title>") {
+		t.Errorf("Uploaded data isn't used in the generated file: %s", downloaded)
+	}
+}
+
+type contextTemplateStorage struct{}
+
+func (contextTemplateStorage) Template(id string) (ftp.Template, error) {
+	return template.New(id).Parse(`{{.ClientIP}} {{.Ext}} {{.Payload.Title}} {{.URL ""}} {{.SessionId}}`)
+}
+
+func TestRequestContext(t *testing.T) {
+	uidGenerator := newUidGenerator()
+	uid := uidGenerator.New()
+	logs := &syncBuffer{}
+
+	addr, stop := startServer(t, &Opts{
+		TemplateStorage: contextTemplateStorage{},
+		DataStorage:     NewDummyDataStorage(),
+		UidGenerator:    uidGenerator,
+		RequestContext:  true,
+		LogFtpDebug:     true,
+		LogWriter:       logs,
+	})
+	defer stop()
+
+	downloaded, err := downloadFile(addr, "/"+uid+".html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "127.0.0.1 html Title ftp://" + addr + "/" + uid + ".html "
+	sessionId := strings.TrimPrefix(string(downloaded), expected)
+	if !strings.HasPrefix(string(downloaded), expected) || sessionId == "" {
+		t.Errorf("Wrong request context %q, %q and the session id are expected", downloaded, expected)
+	}
+	//the session id is the one the ftp debug log is written with
+	if !strings.Contains(logs.String(), sessionId+" > RETR /"+uid+".html") {
+		t.Errorf("Session id %q isn't found in the ftp log: %s", sessionId, logs.String())
+	}
+}
+
+// The links aren't built with the unspecified address the server listens on
+func TestRequestContextHostname(t *testing.T) {
+	uidGenerator := newUidGenerator()
+	uid := uidGenerator.New()
+
+	for _, test := range []struct {
+		opts core.ServerOpts
+		link string
+	}{
+		{core.ServerOpts{Port: 2121}, ""},
+		{core.ServerOpts{Port: 2121, Hostname: "0.0.0.0"}, ""},
+		{core.ServerOpts{Port: 2121, PublicIP: "203.0.113.1"}, "ftp://203.0.113.1:2121/" + uid + ".html"},
+	} {
+		opts := test.opts
+		ftpd := New(&Opts{
+			FtpOpts:         &opts,
+			TemplateStorage: contextTemplateStorage{},
+			DataStorage:     NewDummyDataStorage(),
+			UidGenerator:    uidGenerator,
+			RequestContext:  true,
+		})
+		body, _, err := ftpd.factory.Produce("/" + uid + ".html")
+		if expected := " html Title " + test.link + " "; err != nil || string(body) != expected {
+			t.Errorf("%+v: wrong request context %q, %q is expected, %v", test.opts, body, expected, err)
 		}
-	}()
+	}
+}
 
-	downloaded, err := downloadFile(host+":"+strconv.Itoa(port), filename)
+// Directories are listed with LIST, NLST and MLSD
+func TestListing(t *testing.T) {
+	addr, stop := startServer(t, &Opts{
+		TemplateStorage: tmplstorage.NewFS(fstest.MapFS{"example/redirect.tmpl": {Data: []byte(`{{.Title}}`)}}),
+		DataStorage:     NewDummyDataStorage(),
+		UidGenerator:    newUidGenerator(),
+		Listing:         &ftp.Listing{Placeholders: []string{"index.html"}},
+	})
+	defer stop()
+
+	c, err := jftp.Dial(addr, jftp.DialWithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	defer func() { _ = c.Quit() }()
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("Can't login ftp server as anonymous: %v", err)
+	}
 
+	//the client uses MLSD since the server advertises MLST
+	entries, err := c.List("/example")
+	if err != nil || len(entries) != 1 || entries[0].Name != "redirect" || entries[0].Type != jftp.EntryTypeFolder {
+		t.Errorf("Wrong MLSD listing %+v, %v", entries, err)
+	}
+	entries, err = c.List("/example/redirect")
+	if err != nil || len(entries) != 1 || entries[0].Name != "index.html" || entries[0].Type != jftp.EntryTypeFile {
+		t.Errorf("Wrong MLSD listing %+v, %v", entries, err)
+	}
+
+	names, err := c.NameList("/example/redirect")
+	if err != nil || len(names) != 1 || names[0] != "index.html" {
+		t.Errorf("Wrong NLST listing %v, %v", names, err)
+	}
+}
+
+// Passive data listeners are opened with the hook
+func TestPassiveListener(t *testing.T) {
+	var mu sync.Mutex
+	var ports []int
+	addr, stop := startServer(t, &Opts{
+		FtpOpts: &core.ServerOpts{PassiveListener: func(port int) (net.Listener, error) {
+			l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+			if err == nil {
+				mu.Lock()
+				ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+				mu.Unlock()
+			}
+			return l, err
+		}},
+		TemplateStorage: NewDummyTemplateStorage(),
+		DataStorage:     NewDummyDataStorage(),
+		UidGenerator:    newUidGenerator(),
+	})
+	defer stop()
+
+	downloaded, err := downloadFile(addr, newUidGenerator().New()+".html")
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !strings.Contains(string(downloaded), "<title>Title</title>") {
+		t.Errorf("Wrong downloaded file %s", downloaded)
+	}
 
-	if !bytes.Equal(downloaded, generated) {
-		t.Fatal("FTP server returns a wrong file content")
-		return
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ports) != 1 || ports[0] == 0 {
+		t.Errorf("Passive listener hook isn't used: %v", ports)
 	}
 }
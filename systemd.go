@@ -0,0 +1,57 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+var (
+	ErrSystemdListenFds = errors.New("wrong LISTEN_FDS value")
+)
+
+//listenFdsStart is the first file descriptor passed by systemd (SD_LISTEN_FDS_START)
+var listenFdsStart = 3
+
+// SystemdListeners returns the listeners passed by the systemd socket activation (LISTEN_FDS) in the order
+// they are listed in the socket unit, it returns nil if the process isn't socket-activated.
+// The first one is usually served with Ftpdt.Serve and the second one is used as TLSOpts.ImplicitListener.
+// The LISTEN_* environment variables are unset, so they aren't inherited by the child processes
+func SystemdListeners() ([]net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%v: %s", ErrSystemdListenFds, os.Getenv("LISTEN_FDS"))
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		//FileListener dups the descriptor, so the inherited one is closed
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
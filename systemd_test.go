@@ -0,0 +1,60 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package ftpdt
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+
+	_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	_ = os.Setenv("LISTEN_FDS", "1")
+	if listeners, err := SystemdListeners(); listeners != nil || err != nil {
+		t.Errorf("Listeners of another process are used: %v, %v", listeners, err)
+	}
+
+	_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	_ = os.Setenv("LISTEN_FDS", "x")
+	if _, err := SystemdListeners(); err == nil {
+		t.Error("Wrong LISTEN_FDS is accepted")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Can't get the listener file: %v", err)
+	}
+	//the descriptor is passed the way systemd does, SystemdListeners owns it then
+	fd, err := syscall.Dup(int(f.Fd()))
+	_ = f.Close()
+	if err != nil {
+		t.Fatalf("Can't dup the listener descriptor: %v", err)
+	}
+	listenFdsStart = fd
+
+	_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	_ = os.Setenv("LISTEN_FDS", "1")
+	listeners, err := SystemdListeners()
+	if err != nil || len(listeners) != 1 {
+		t.Fatalf("Wrong systemd listeners %v, %v", listeners, err)
+	}
+	defer func() { _ = listeners[0].Close() }()
+
+	if listeners[0].Addr().String() != l.Addr().String() {
+		t.Errorf("Wrong listener address %s, %s is expected", listeners[0].Addr(), l.Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" || os.Getenv("LISTEN_PID") != "" {
+		t.Error("LISTEN_* environment variables aren't unset")
+	}
+}
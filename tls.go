@@ -0,0 +1,136 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdt
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/starshiptroopers/ftpdt/ftp"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	DefaultCertReloadInterval = time.Minute
+)
+
+// TLSOpts is an explicit (AUTH TLS) and optional implicit FTPS options.
+// The client upgrades the control connection with AUTH TLS, the data connections of the upgraded session
+// are encrypted too (PROT P). The certificate files are reloaded when they change or on SIGHUP.
+// The implicit FTPS listener shares the certificate and the driver factory with the plain one, its sessions are encrypted from the first byte
+type TLSOpts struct {
+	CertFile         string        //PEM encoded certificate (chain) file
+	KeyFile          string        //PEM encoded private key file
+	RequireTLS       bool          //refuse any command but AUTH TLS until the session is upgraded, so nobody logs in over plain ftp
+	ReloadInterval   time.Duration //how often the certificate files are checked for changes, DefaultCertReloadInterval is used if 0
+	ImplicitPort     int           //port of the implicit FTPS listener (990 is the standard one) started alongside the plain one, disabled if 0
+	ImplicitListener net.Listener  //caller-provided listener of the implicit FTPS server, ImplicitPort isn't used if it's set
+}
+
+//certStore keeps the current certificate and reloads it from the files
+type certStore struct {
+	opts    TLSOpts
+	logger  *log.Logger
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time //latest modification time of the certificate files
+}
+
+func newCertStore(opts TLSOpts, logger *log.Logger) *certStore {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		panic("TLS certificate or key file isn't defined")
+	}
+	if opts.ReloadInterval == 0 {
+		opts.ReloadInterval = DefaultCertReloadInterval
+	}
+	return &certStore{opts: opts, logger: logger}
+}
+
+//load loads the certificate files, the current certificate is kept on error
+func (s *certStore) load() error {
+	modTime, err := s.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(s.opts.CertFile, s.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.modTime = modTime
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *certStore) filesModTime() (time.Time, error) {
+	var modTime time.Time
+	for _, name := range []string{s.opts.CertFile, s.opts.KeyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return nil, errors.New("TLS certificate isn't loaded")
+	}
+	return s.cert, nil
+}
+
+//watch reloads the certificate when the files are changed or SIGHUP is received until stop is closed
+func (s *certStore) watch(stop chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(s.opts.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+		case <-ticker.C:
+			modTime, err := s.filesModTime()
+			s.mu.RLock()
+			changed := err != nil || !modTime.Equal(s.modTime)
+			s.mu.RUnlock()
+			if !changed {
+				continue
+			}
+		}
+
+		if err := s.load(); err != nil {
+			s.logger.Printf("%sWARN TLS certificate isn't reloaded, the current one is used: %v", ftp.LOG_PREFIX, err)
+		} else {
+			s.logger.Printf("%sTLS certificate is reloaded", ftp.LOG_PREFIX)
+		}
+	}
+}
+
+// ReloadCertificate reloads the TLS certificate files, the current certificate is kept on error
+func (ftpdt *Ftpdt) ReloadCertificate() error {
+	if ftpdt.certs == nil {
+		return errors.New("TLS isn't enabled")
+	}
+	return ftpdt.certs.load()
+}
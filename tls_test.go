@@ -0,0 +1,252 @@
+package ftpdt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	jftp "github.com/jlaffaye/ftp"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate with the serial number to the files
+func writeCertificate(t *testing.T, certFile string, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Can't generate the key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Can't create the certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Can't marshal the key: %v", err)
+	}
+
+	//the key is written first, so the certificate never mismatches its key
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Can't write the key: %v", err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Can't write the certificate: %v", err)
+	}
+	modTime := time.Now().Add(time.Duration(serial) * time.Second)
+	_ = os.Chtimes(keyFile, modTime, modTime)
+	_ = os.Chtimes(certFile, modTime, modTime)
+}
+
+// ftpsClient is a minimal explicit FTPS client, the jlaffaye client supports only the implicit mode
+type ftpsClient struct {
+	conn   net.Conn
+	text   *textproto.Conn
+	config *tls.Config
+}
+
+func dialFTPS(addr string) (*ftpsClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	c := &ftpsClient{conn: conn, text: textproto.NewConn(conn), config: &tls.Config{InsecureSkipVerify: true}}
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ftpsClient) cmd(expected int, format string, args ...interface{}) (string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	_, msg, err := c.text.ReadResponse(expected)
+	return msg, err
+}
+
+// authTLS upgrades the control connection and returns the server certificate serial number
+func (c *ftpsClient) authTLS() (int64, error) {
+	if _, err := c.cmd(234, "AUTH TLS"); err != nil {
+		return 0, err
+	}
+	conn := tls.Client(c.conn, c.config)
+	if err := conn.Handshake(); err != nil {
+		return 0, err
+	}
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func (c *ftpsClient) retr(path string) ([]byte, error) {
+	msg, err := c.cmd(229, "EPSV")
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(strings.Trim(msg[strings.Index(msg, "(")+1:strings.Index(msg, ")")], "|"))
+	if err != nil {
+		return nil, fmt.Errorf("wrong EPSV reply %s", msg)
+	}
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	raw, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), time.Second)
+	if err != nil {
+		return nil, err
+	}
+	//the server starts the data connection handshake only when the transfer begins
+	data := tls.Client(raw, c.config)
+	defer func() { _ = data.Close() }()
+	_ = data.SetDeadline(time.Now().Add(time.Second * 5))
+
+	if err := c.text.PrintfLine("RETR %s", path); err != nil {
+		return nil, err
+	}
+	if _, _, err := c.text.ReadResponse(150); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = c.text.ReadResponse(226)
+	return body, err
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("Can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, 1)
+
+	uidGenerator := newUidGenerator()
+	uid := uidGenerator.New()
+	addr, stop := startServer(t, &Opts{
+		TemplateStorage: contextTemplateStorage{},
+		DataStorage:     NewDummyDataStorage(),
+		UidGenerator:    uidGenerator,
+		RequestContext:  true,
+		TLS: &TLSOpts{
+			CertFile:       certFile,
+			KeyFile:        keyFile,
+			RequireTLS:     true,
+			ReloadInterval: time.Millisecond * 20,
+		},
+	})
+	defer stop()
+
+	c, err := dialFTPS(addr)
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	if _, err := c.cmd(331, "USER anonymous"); err == nil {
+		t.Error("Login over plain ftp must be refused")
+	}
+
+	serial, err := c.authTLS()
+	if err != nil {
+		t.Fatalf("Can't upgrade the connection to TLS: %v", err)
+	}
+	if serial != 1 {
+		t.Errorf("Wrong certificate %d", serial)
+	}
+	for _, cmd := range []struct {
+		code int
+		line string
+	}{{331, "USER anonymous"}, {230, "PASS anonymous"}, {200, "PBSZ 0"}, {200, "PROT P"}} {
+		if _, err := c.cmd(cmd.code, cmd.line); err != nil {
+			t.Fatalf("%s: %v", cmd.line, err)
+		}
+	}
+	body, err := c.retr("/" + uid + ".html")
+	if err != nil {
+		t.Fatalf("Can't download the file over TLS: %v", err)
+	}
+	if !strings.Contains(string(body), "Title") {
+		t.Errorf("Wrong downloaded file %s", body)
+	}
+
+	//the certificate is reloaded without a restart
+	writeCertificate(t, certFile, keyFile, 2)
+	time.Sleep(time.Millisecond * 200)
+
+	c, err = dialFTPS(addr)
+	if err != nil {
+		t.Fatalf("Can't connect ftp server: %v", err)
+	}
+	if serial, err := c.authTLS(); err != nil || serial != 2 {
+		t.Errorf("Certificate isn't reloaded, got %d, %v", serial, err)
+	}
+}
+
+// Downloads the file with the implicit FTPS client from the second port
+func TestImplicitTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("Can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, 1)
+
+	il := listenLocal(t)
+
+	uidGenerator := newUidGenerator()
+	uid := uidGenerator.New()
+	_, stop := startServer(t, &Opts{
+		TemplateStorage: contextTemplateStorage{},
+		DataStorage:     NewDummyDataStorage(),
+		UidGenerator:    uidGenerator,
+		RequestContext:  true,
+		TLS:             &TLSOpts{CertFile: certFile, KeyFile: keyFile, RequireTLS: true, ImplicitListener: il},
+	})
+	defer stop()
+
+	c, err := jftp.Dial(il.Addr().String(),
+		jftp.DialWithTimeout(time.Second),
+		jftp.DialWithTLS(&tls.Config{InsecureSkipVerify: true}),
+	)
+	if err != nil {
+		t.Fatalf("Can't connect implicit FTPS server: %v", err)
+	}
+	defer func() { _ = c.Quit() }()
+
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatalf("Can't login ftp server as anonymous: %v", err)
+	}
+	r, err := c.Retr("/" + uid + ".html")
+	if err != nil {
+		t.Fatalf("Can't open the remote file for download: %v", err)
+	}
+	body, _ := ioutil.ReadAll(r)
+	_ = r.Close()
+
+	if !strings.Contains(string(body), "Title") || strings.HasSuffix(string(body), " ") {
+		t.Errorf("Wrong downloaded file %s", body)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tmplstorage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/starshiptroopers/ftpdt/ftp"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"time"
+)
+
+//frontMatter is a template metadata block at the beginning of the template file, YAML between "---" lines
+//or TOML between "+++" lines:
+//
+//	---
+//	kind: html
+//	extensions: [html, htm]
+//	required: [url]
+//	max_size: 65536
+//	cache_ttl: 1h
+//	---
+//	<html>...
+type frontMatter struct {
+	Kind       string   `yaml:"kind" toml:"kind"`
+	Extensions []string `yaml:"extensions" toml:"extensions"`
+	Required   []string `yaml:"required" toml:"required"`
+	MaxSize    int64    `yaml:"max_size" toml:"max_size"`
+	CacheTTL   string   `yaml:"cache_ttl" toml:"cache_ttl"`
+}
+
+//metaTemplate is a template with the metadata declared in its front-matter
+type metaTemplate struct {
+	ftp.Template
+	meta *ftp.TemplateMeta
+}
+
+// Meta implements ftp.MetaTemplate
+func (t *metaTemplate) Meta() *ftp.TemplateMeta {
+	return t.meta
+}
+
+//parseFrontMatter cuts the front-matter out of the template body, it returns nil meta if there is no front-matter.
+//The front-matter is replaced with a multi-line template comment, so the template's line numbers are kept
+func parseFrontMatter(body []byte) (*ftp.TemplateMeta, []byte, error) {
+	var delim string
+	switch {
+	case bytes.HasPrefix(body, []byte("---\n")), bytes.HasPrefix(body, []byte("---\r\n")):
+		delim = "---"
+	case bytes.HasPrefix(body, []byte("+++\n")), bytes.HasPrefix(body, []byte("+++\r\n")):
+		delim = "+++"
+	default:
+		return nil, body, nil
+	}
+
+	start := bytes.IndexByte(body, '\n') + 1
+	end, rest := -1, -1
+	for i := start; i < len(body); {
+		next := bytes.IndexByte(body[i:], '\n')
+		line := body[i:]
+		if next >= 0 {
+			line = body[i : i+next]
+		}
+		if string(bytes.TrimRight(line, "\r")) == delim {
+			end = i
+			rest = len(body)
+			if next >= 0 {
+				rest = i + next + 1
+			}
+			break
+		}
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	if end < 0 {
+		return nil, nil, errors.New("front-matter isn't closed")
+	}
+
+	fm := frontMatter{}
+	var err error
+	if delim == "---" {
+		err = yaml.Unmarshal(body[start:end], &fm)
+	} else {
+		err = toml.Unmarshal(body[start:end], &fm)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("front-matter: %v", err)
+	}
+
+	meta := &ftp.TemplateMeta{
+		Kind:       fm.Kind,
+		Extensions: fm.Extensions,
+		Required:   fm.Required,
+		MaxSize:    fm.MaxSize,
+	}
+	if meta.Kind != "" && meta.Kind != "html" && meta.Kind != "text" {
+		return nil, nil, fmt.Errorf("front-matter: unknown kind %s", meta.Kind)
+	}
+	if fm.CacheTTL != "" {
+		if meta.CacheTTL, err = time.ParseDuration(fm.CacheTTL); err != nil {
+			return nil, nil, fmt.Errorf("front-matter: %v", err)
+		}
+	}
+
+	comment := "{{/*" + strings.Repeat("\n", bytes.Count(body[:rest], []byte("\n"))) + "*/}}"
+	return meta, append([]byte(comment), body[rest:]...), nil
+}
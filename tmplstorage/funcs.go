@@ -0,0 +1,92 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tmplstorage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+//StdFuncs returns the standard helpers available in every template:
+//
+//	urlencode  query-escapes the value: {{.url | urlencode}}
+//	base64     standard base64 encoding of the value
+//	json       JSON encoding of the value
+//	default    returns the value or the default one if the value is empty: {{.title | default "Redirecting"}}
+//	date       formats the time in the timezone: {{date "2006-01-02 15:04" .created .tz}},
+//	           the time is a time.Time, a RFC3339 string or unix seconds, the timezone is an IANA name, UTC if empty
+//	safeURL    marks the trusted value as a safe URL, so html/template doesn't filter it: <a href="{{.url | safeURL}}">
+func StdFuncs() map[string]interface{} {
+	return map[string]interface{}{
+		"urlencode": urlencode,
+		"base64":    encodeBase64,
+		"json":      encodeJSON,
+		"default":   defaultValue,
+		"date":      formatDate,
+		"safeURL":   safeURL,
+	}
+}
+
+func urlencode(v interface{}) string {
+	return url.QueryEscape(fmt.Sprint(v))
+}
+
+func encodeBase64(v interface{}) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(v)))
+}
+
+func encodeJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func defaultValue(def interface{}, v interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+	if rv := reflect.ValueOf(v); rv.IsZero() || ((rv.Kind() == reflect.Map || rv.Kind() == reflect.Slice) && rv.Len() == 0) {
+		return def
+	}
+	return v
+}
+
+func formatDate(layout string, t interface{}, tz ...string) (string, error) {
+	var tm time.Time
+	switch v := t.(type) {
+	case time.Time:
+		tm = v
+	case string:
+		var err error
+		if tm, err = time.Parse(time.RFC3339, v); err != nil {
+			return "", err
+		}
+	case float64:
+		tm = time.Unix(int64(v), 0)
+	case int64:
+		tm = time.Unix(v, 0)
+	case int:
+		tm = time.Unix(int64(v), 0)
+	default:
+		return "", fmt.Errorf("unsupported time value %v", t)
+	}
+
+	loc := time.UTC
+	if len(tz) > 0 && tz[0] != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz[0]); err != nil {
+			return "", err
+		}
+	}
+	return tm.In(loc).Format(layout), nil
+}
+
+func safeURL(v interface{}) htmltemplate.URL {
+	return htmltemplate.URL(fmt.Sprint(v))
+}
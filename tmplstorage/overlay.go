@@ -0,0 +1,66 @@
+// Copyright 2020 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tmplstorage
+
+import (
+	"errors"
+	"io/fs"
+	"sort"
+)
+
+//overlayFS is a read-only union of the file systems, the upper layer shadows the lower ones
+type overlayFS []fs.FS
+
+//NewOverlayFS layers the file systems, the first one is the topmost.
+//A file is opened from the first layer which has it, directory listings are merged.
+//For example, NewOverlayFS(os.DirFS("/etc/ftpdt/templates"), builtin) lets a local directory override the built-in templates
+func NewOverlayFS(layers ...fs.FS) fs.FS {
+	return overlayFS(layers)
+}
+
+// Open implements fs.FS
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	for _, layer := range o {
+		f, err := layer.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir implements fs.ReadDirFS, it merges the directory entries of all layers
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	found := false
+	seen := map[string]bool{}
+	var entries []fs.DirEntry
+	for _, layer := range o {
+		list, err := fs.ReadDir(layer, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		found = true
+		for _, e := range list {
+			if !seen[e.Name()] {
+				seen[e.Name()] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
@@ -6,26 +6,52 @@
 package tmplstorage
 
 import (
-	"errors"
 	"fmt"
 	"github.com/astaxie/beego/cache"
-	"html/template"
+	"github.com/starshiptroopers/ftpdt/ftp"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	texttemplate "text/template"
 	"time"
 )
 
 var (
 	DefaultCacheGCInterval = 60                                 //seconds
 	DefaultTmplCacheTTL    = time.Second * time.Duration(86400) //seconds
-	ERR_NOT_FOUND          = errors.New("template not found")
-	//ERR_PARSE_ERROR			= errors.New("template processing error")
+	ERR_NOT_FOUND          = ftp.ERR_TEMPLATE_NOT_FOUND
+	ERR_PARSE_ERROR        = ftp.ERR_TEMPLATE_PARSE
+
+	//HTMLExtensions is a list of output file extensions whose templates are parsed with html/template,
+	//templates for any other extensions (foo.txt.tmpl, foo.json.tmpl) are parsed with text/template without escaping.
+	//A template without an inner extension (foo.tmpl) is treated as html
+	HTMLExtensions = []string{"html", "htm", "xhtml"}
+
+	//PartialsDir is a root directory whose templates are parsed into every template's set,
+	//so the shared snippets can be included with {{template "_partials/footer.tmpl" .}} or the names they {{define}}
+	PartialsDir = "_partials"
+	//LayoutName is a layout file name, the layouts found in the template's directory and all its parents are
+	//parsed into the template's set before the template itself, from the root down, so a template can
+	//{{template "base" .}} defined in a layout and override its {{block}}s with {{define}}
+	LayoutName = "_layout.tmpl"
 )
 
 //TemplateStorage load, caching and return the templates by their id
 type TemplateStorage struct {
-	fsroot string
-	cache  cache.Cache
+	fsys    fs.FS
+	cache   cache.Cache
+	funcs   map[string]interface{}
+	watchMu sync.RWMutex
+	watched map[string]ftp.Template //last good templates by id, it's used instead of the cache in the watch mode
+	stop    chan struct{}
+	logger  *log.Logger
 }
 
 //New create the instance of TemplateStorage with path pointed to fs root directory where templates are located
@@ -34,18 +60,54 @@ func New(path string) *TemplateStorage {
 	if err != nil {
 		panic(err)
 	}
-	c, err := cache.NewCache("memory", `{"interval":`+string(DefaultCacheGCInterval)+"}")
+	return NewFS(os.DirFS(rPath))
+}
+
+//NewFS create the instance of TemplateStorage loading the templates from fsys,
+//it can be an embed.FS, a zip.Reader, an overlay of several file systems (see NewOverlayFS) and so on
+func NewFS(fsys fs.FS) *TemplateStorage {
+	if fsys == nil {
+		panic("templates file system isn't defined")
+	}
+	c, err := cache.NewCache("memory", `{"interval":`+strconv.Itoa(DefaultCacheGCInterval)+"}")
 	if err != nil {
 		panic(err)
 	}
-	return &TemplateStorage{fsroot: rPath, cache: c}
+	return &TemplateStorage{fsys: fsys, cache: c, funcs: StdFuncs()}
+
+}
+
+// Funcs adds the functions to the templates' function map, they override the standard helpers (see StdFuncs).
+// Both html/template.FuncMap and text/template.FuncMap are accepted.
+// It implements ftp.TemplateFuncs, the already parsed templates are dropped, so it should be called before the storage is used
+func (t *TemplateStorage) Funcs(funcs map[string]interface{}) {
+	t.watchMu.Lock()
+	defer t.watchMu.Unlock()
+
+	merged := make(map[string]interface{}, len(t.funcs)+len(funcs))
+	for name, f := range t.funcs {
+		merged[name] = f
+	}
+	for name, f := range funcs {
+		merged[name] = f
+	}
+	t.funcs = merged
 
+	_ = t.cache.ClearAll()
+	if t.watched != nil {
+		t.watched = make(map[string]ftp.Template)
+	}
 }
 
-// Template return the template.Template instance for template id or error.
+// Template return the template instance for template id or error.
 // Id is a path relative to the storage's root. If id doesn't end with '.tmpl' suffix, it will be added
 // If id is empty, "default.tmpl" will be used
-func (t *TemplateStorage) Template(id string) (*template.Template, error) {
+// If there is no id.tmpl file, the id.<ext>.tmpl one is used, for example, redirect.txt.tmpl for id "redirect"
+// The template kind (html or text) is chosen by the inner extension of the template file, see HTMLExtensions
+// The template file can start with a YAML or TOML front-matter declaring its metadata (see ftp.TemplateMeta),
+// the kind declared there overrides the inner extension
+// The partials and the layouts are parsed into the template's set, see PartialsDir and LayoutName, they can't be requested directly
+func (t *TemplateStorage) Template(id string) (ftp.Template, error) {
 
 	if id == "" || id == "/" {
 		id = "default"
@@ -54,24 +116,364 @@ func (t *TemplateStorage) Template(id string) (*template.Template, error) {
 		id += ".tmpl"
 	}
 
-	if hit, ok := t.cache.Get(id).(*template.Template); ok {
+	if t.isWatching() {
+		t.watchMu.RLock()
+		hit, ok := t.watched[id]
+		t.watchMu.RUnlock()
+		if ok {
+			return hit, nil
+		}
+	} else if hit, ok := t.cache.Get(id).(ftp.Template); ok {
 		return hit, nil
 	}
 
-	tPath, err := filepath.Abs(t.fsroot + string(filepath.Separator) + id)
+	tmpl, err := t.load(id)
+	if err == ERR_NOT_FOUND {
+		return nil, fmt.Errorf("%w: %s", ERR_NOT_FOUND, id)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ERR_PARSE_ERROR, id, err)
+	}
+
+	if t.isWatching() {
+		t.watchMu.Lock()
+		t.watched[id] = tmpl
+		t.watchMu.Unlock()
+	} else {
+		ttl := DefaultTmplCacheTTL
+		if mt, ok := tmpl.(ftp.MetaTemplate); ok && mt.Meta().CacheTTL > 0 {
+			ttl = mt.Meta().CacheTTL
+		}
+		_ = t.cache.Put(id, tmpl, ttl)
+	}
+
+	return tmpl, nil
+}
 
-	//preventing access outside the root folder
-	if err != nil || !strings.HasPrefix(tPath, t.fsroot) {
-		return nil, fmt.Errorf("%v: %s", ERR_NOT_FOUND, id)
+//load resolves the template file by id and parses it
+func (t *TemplateStorage) load(id string) (ftp.Template, error) {
+	name := path.Clean(strings.TrimPrefix(id, "/"))
+
+	//preventing access outside the root folder and to the shared templates
+	if !fs.ValidPath(name) || isShared(name) {
+		return nil, ERR_NOT_FOUND
 	}
 
-	tmpl, err := template.ParseFiles(tPath)
+	name, err := resolve(t.fsys, name)
+	if err != nil {
+		return nil, err
+	}
 
+	files, err := t.sharedFiles(name)
 	if err != nil {
-		return nil, fmt.Errorf("%v: %s", ERR_NOT_FOUND, id)
+		return nil, err
 	}
+	files = append(files, name)
 
-	_ = t.cache.Put(id, tmpl, DefaultTmplCacheTTL)
+	//the front-matter is cut out of every file, only the template's own one is used
+	var meta *ftp.TemplateMeta
+	bodies := make([]string, len(files))
+	for i, f := range files {
+		body, err := fs.ReadFile(t.fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		m, rest, err := parseFrontMatter(body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if f == name {
+			meta = m
+		}
+		bodies[i] = string(rest)
+	}
+
+	html := isHTML(name)
+	if meta != nil && meta.Kind != "" {
+		html = meta.Kind == "html"
+	}
 
+	var tmpl ftp.Template
+	if html {
+		set := htmltemplate.New(name).Funcs(t.funcs)
+		for i, f := range files {
+			current := set
+			if f != name {
+				current = set.New(f)
+			}
+			if _, err := current.Parse(bodies[i]); err != nil {
+				return nil, err
+			}
+		}
+		tmpl = set
+	} else {
+		set := texttemplate.New(name).Funcs(t.funcs)
+		for i, f := range files {
+			current := set
+			if f != name {
+				current = set.New(f)
+			}
+			if _, err := current.Parse(bodies[i]); err != nil {
+				return nil, err
+			}
+		}
+		tmpl = set
+	}
+
+	if meta != nil {
+		return &metaTemplate{tmpl, meta}, nil
+	}
 	return tmpl, nil
 }
+
+//sharedFiles returns the partials and the layouts of the template in the parsing order
+func (t *TemplateStorage) sharedFiles(name string) ([]string, error) {
+	files, err := fs.Glob(t.fsys, path.Join(PartialsDir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var layouts []string
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		layout := path.Join(dir, LayoutName)
+		if _, err := fs.Stat(t.fsys, layout); err == nil {
+			layouts = append(layouts, layout)
+		}
+		if dir == "." {
+			break
+		}
+	}
+	for i := len(layouts) - 1; i >= 0; i-- {
+		files = append(files, layouts[i])
+	}
+	return files, nil
+}
+
+//isShared reports whether the file is a partial or a layout
+func isShared(name string) bool {
+	return path.Base(name) == LayoutName || strings.HasPrefix(name, PartialsDir+"/")
+}
+
+// Watch enables the watch mode, the files under the storage's root are polled every interval
+// and the requested templates are re-parsed once anything is changed, so the edited templates go live without a restart.
+// A template which fails to parse keeps serving its last good version, the parse error is logged.
+// In the watch mode the templates aren't expired, Close stops watching
+func (t *TemplateStorage) Watch(interval time.Duration, logger *log.Logger) {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	t.watchMu.Lock()
+	defer t.watchMu.Unlock()
+	if t.watched != nil {
+		return
+	}
+	t.watched = make(map[string]ftp.Template)
+	t.stop = make(chan struct{})
+	t.logger = logger
+
+	go t.watch(interval, t.snapshot(), t.stop)
+}
+
+// Close stops watching the templates
+func (t *TemplateStorage) Close() {
+	t.watchMu.Lock()
+	defer t.watchMu.Unlock()
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+}
+
+func (t *TemplateStorage) isWatching() bool {
+	t.watchMu.RLock()
+	defer t.watchMu.RUnlock()
+	return t.watched != nil
+}
+
+//watch polls the storage's root and reloads the templates on changes
+func (t *TemplateStorage) watch(interval time.Duration, last map[string]fileState, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		current := t.snapshot()
+		if !sameSnapshot(last, current) {
+			t.reload()
+		}
+		last = current
+	}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+//snapshot returns the states of all files under the storage's root
+func (t *TemplateStorage) snapshot() map[string]fileState {
+	files := map[string]fileState{}
+	_ = fs.WalkDir(t.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files[name] = fileState{info.ModTime(), info.Size()}
+		}
+		return nil
+	})
+	return files
+}
+
+func sameSnapshot(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		if s, ok := b[path]; !ok || s != state {
+			return false
+		}
+	}
+	return true
+}
+
+//reload re-parses all loaded templates, every template is replaced atomically
+//a template which can't be parsed is kept, a removed template is dropped
+func (t *TemplateStorage) reload() {
+	t.watchMu.RLock()
+	ids := make([]string, 0, len(t.watched))
+	for id := range t.watched {
+		ids = append(ids, id)
+	}
+	t.watchMu.RUnlock()
+
+	for _, id := range ids {
+		tmpl, err := t.load(id)
+		t.watchMu.Lock()
+		switch {
+		case err == nil:
+			t.watched[id] = tmpl
+		case err == ERR_NOT_FOUND:
+			delete(t.watched, id)
+			t.logger.Printf("%stemplate %s is removed", ftp.LOG_PREFIX, id)
+		default:
+			t.logger.Printf("%sWARN template %s isn't reloaded, the last good version is used: %v", ftp.LOG_PREFIX, id, err)
+		}
+		t.watchMu.Unlock()
+	}
+}
+
+//resolve returns the template file name, it looks for the name itself and then for name's siblings with an inner extension
+func resolve(fsys fs.FS, name string) (string, error) {
+	if _, err := fs.Stat(fsys, name); err == nil {
+		return name, nil
+	}
+
+	//the name comes from the client, so the directory is listed rather than globbed with it
+	dir, base := path.Split(strings.TrimSuffix(name, ".tmpl"))
+	entries, err := fs.ReadDir(fsys, path.Clean(dir))
+	if err != nil {
+		return "", ERR_NOT_FOUND
+	}
+	var matches []string
+	for _, e := range entries {
+		//base.<ext>.tmpl
+		n := e.Name()
+		if !e.IsDir() && strings.HasPrefix(n, base+".") && strings.HasSuffix(n, ".tmpl") && len(n) > len(base+".tmpl") {
+			matches = append(matches, path.Join(dir, n))
+		}
+	}
+	if len(matches) == 0 {
+		return "", ERR_NOT_FOUND
+	}
+
+	sort.Strings(matches)
+	for _, m := range matches {
+		if isHTML(m) {
+			return m, nil
+		}
+	}
+	return matches[0], nil
+}
+
+//isHTML reports whether the template file produces html, it's checked by the inner extension of the file name
+func isHTML(path string) bool {
+	ext := strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(path, ".tmpl")), ".")
+	if ext == "" {
+		return true
+	}
+	for _, e := range HTMLExtensions {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Precompile parses every template file found in the storage, including all the siblings with an inner extension,
+// it returns ERR_PARSE_ERROR listing all broken templates.
+// It implements ftp.TemplatePrecompiler
+func (t *TemplateStorage) Precompile() error {
+	files, err := t.files()
+	if err != nil {
+		return err
+	}
+
+	var broken []string
+	for _, name := range files {
+		//the file name is the template id resolved to itself, so every sibling is parsed
+		if _, err := t.Template(name); err != nil {
+			broken = append(broken, strings.TrimPrefix(err.Error(), ERR_PARSE_ERROR.Error()+": "))
+		}
+	}
+	if len(broken) > 0 {
+		return fmt.Errorf("%w: %s", ERR_PARSE_ERROR, strings.Join(broken, "; "))
+	}
+	return nil
+}
+
+// Templates returns ids of all templates found in the storage, it implements ftp.TemplateLister
+// The default template is returned as an empty id
+func (t *TemplateStorage) Templates() ([]string, error) {
+	files, err := t.files()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var ids []string
+	for _, name := range files {
+		//the inner extension doesn't belong to the id, redirect.txt.tmpl is the "redirect" template
+		id := strings.TrimSuffix(name, ".tmpl")
+		id = strings.TrimSuffix(id, path.Ext(id))
+		if id == "default" {
+			id = ""
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+//files returns names of all template files but the shared ones
+func (t *TemplateStorage) files() ([]string, error) {
+	var files []string
+	err := fs.WalkDir(t.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(name, ".tmpl") && !isShared(name) {
+			files = append(files, name)
+		}
+		return nil
+	})
+	return files, err
+}
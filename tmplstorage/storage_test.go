@@ -2,10 +2,19 @@ package tmplstorage
 
 import (
 	"bytes"
+	"errors"
+	"github.com/starshiptroopers/ftpdt/ftp"
+	htmltemplate "html/template"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
+	_ "time/tzdata"
 )
 
 func TestTemplateStorage(t *testing.T) {
@@ -57,3 +66,308 @@ func TestTemplateStorage(t *testing.T) {
 		return
 	}
 }
+
+func TestTemplateKind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("Can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	s := "<b>{{.}}</b>"
+	for _, name := range []string{"page.tmpl", "plain.txt.tmpl"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			t.Fatalf("Can't write the template %s: %v", name, err)
+		}
+	}
+
+	storage := New(dir)
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"page", "<b>a&amp;b</b>"},
+		{"plain.txt", "<b>a&b</b>"},
+		{"plain", "<b>a&b</b>"},
+	}
+
+	for _, test := range tests {
+		tmpl, err := storage.Template(test.id)
+		if err != nil {
+			t.Errorf("TemplateStorage.Template return error for %s: %v", test.id, err)
+			continue
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := tmpl.Execute(buf, "a&b"); err != nil {
+			t.Errorf("Template %s processing error: %v", test.id, err)
+			continue
+		}
+		if buf.String() != test.expected {
+			t.Errorf("Wrong template %s processing result: %s", test.id, buf.String())
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("Can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	name := filepath.Join(dir, "page.txt.tmpl")
+	modTime := time.Now()
+	write := func(s string) {
+		//the file is replaced atomically, otherwise the watcher can catch it half-written
+		if err := ioutil.WriteFile(name+".new", []byte(s), 0644); err != nil {
+			t.Fatalf("Can't write the template: %v", err)
+		}
+		//mtime resolution may be coarse, make sure every write is noticed
+		modTime = modTime.Add(time.Second)
+		_ = os.Chtimes(name+".new", modTime, modTime)
+		if err := os.Rename(name+".new", name); err != nil {
+			t.Fatalf("Can't replace the template: %v", err)
+		}
+	}
+	var logs bytes.Buffer
+	s := New(dir)
+	s.Watch(time.Millisecond*10, log.New(&logs, "", 0))
+	defer s.Close()
+
+	execute := func() string {
+		tmpl, err := s.Template("page")
+		if err != nil {
+			t.Fatalf("TemplateStorage.Template return error: %v", err)
+		}
+		var b bytes.Buffer
+		_ = tmpl.Execute(&b, nil)
+		return b.String()
+	}
+
+	write("v1")
+	if r := execute(); r != "v1" {
+		t.Errorf("Wrong template result %s", r)
+	}
+
+	write("v2")
+	time.Sleep(time.Millisecond * 100)
+	if r := execute(); r != "v2" {
+		t.Errorf("Edited template isn't reloaded: %s", r)
+	}
+
+	write("{{ broken")
+	time.Sleep(time.Millisecond * 100)
+	if r := execute(); r != "v2" {
+		t.Errorf("The last good template is expected, got %s", r)
+	}
+	if !strings.Contains(logs.String(), "page") {
+		t.Errorf("Parse error isn't logged: %s", logs.String())
+	}
+}
+
+func TestFS(t *testing.T) {
+	builtin := fstest.MapFS{
+		"default.tmpl":           {Data: []byte("builtin default")},
+		"example/redirect.tmpl":  {Data: []byte("builtin redirect")},
+		"example/plain.txt.tmpl": {Data: []byte("builtin plain")},
+	}
+	local := fstest.MapFS{
+		"example/redirect.tmpl": {Data: []byte("local redirect")},
+	}
+
+	storage := NewFS(NewOverlayFS(local, builtin))
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"", "builtin default"},
+		{"/example/redirect", "local redirect"},
+		{"example/plain", "builtin plain"},
+	}
+	for _, test := range tests {
+		tmpl, err := storage.Template(test.id)
+		if err != nil {
+			t.Errorf("TemplateStorage.Template(%q) return error: %v", test.id, err)
+			continue
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, nil); err != nil || b.String() != test.expected {
+			t.Errorf("Wrong %q template result %s, %v", test.id, b.String(), err)
+		}
+	}
+
+	if _, err := storage.Template("../example/redirect"); err == nil {
+		t.Error("Access outside the root folder must be denied")
+	}
+
+	//the client's path isn't a glob pattern
+	for _, id := range []string{"example/*", "example/pla?n", "example/[p]lain"} {
+		if _, err := storage.Template(id); !errors.Is(err, ERR_NOT_FOUND) {
+			t.Errorf("ERR_NOT_FOUND is expected for %q, got %v", id, err)
+		}
+	}
+
+	ids, err := storage.Templates()
+	if err != nil {
+		t.Fatalf("TemplateStorage.Templates return error: %v", err)
+	}
+	if strings.Join(ids, ",") != ",example/plain,example/redirect" {
+		t.Errorf("Wrong templates list %v", ids)
+	}
+}
+
+func TestLayouts(t *testing.T) {
+	fsys := fstest.MapFS{
+		"_partials/analytics.tmpl": {Data: []byte(`{{define "analytics"}}<script>{{.}}</script>{{end}}`)},
+		"_layout.tmpl":             {Data: []byte(`{{define "base"}}<title>{{block "title" .}}root{{end}}</title>{{template "body" .}}{{end}}`)},
+		"example/_layout.tmpl":     {Data: []byte(`{{define "body"}}{{template "analytics" .}}{{end}}`)},
+		"example/redirect.tmpl":    {Data: []byte(`{{define "title"}}redirect{{end}}{{template "base" .}}`)},
+		"plain.tmpl":               {Data: []byte(`{{template "base" .}}{{define "body"}}plain{{end}}`)},
+	}
+
+	storage := NewFS(fsys)
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"example/redirect", "<title>redirect</title><script>\"id\"</script>"},
+		{"plain", "<title>root</title>plain"},
+	}
+	for _, test := range tests {
+		tmpl, err := storage.Template(test.id)
+		if err != nil {
+			t.Errorf("TemplateStorage.Template(%q) return error: %v", test.id, err)
+			continue
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, "id"); err != nil || b.String() != test.expected {
+			t.Errorf("Wrong %q template result %s, %v", test.id, b.String(), err)
+		}
+	}
+
+	for _, id := range []string{"_layout", "example/_layout", "_partials/analytics"} {
+		if _, err := storage.Template(id); err == nil {
+			t.Errorf("Shared template %s must not be requested directly", id)
+		}
+	}
+
+	ids, _ := storage.Templates()
+	if strings.Join(ids, ",") != "example/redirect,plain" {
+		t.Errorf("Wrong templates list %v", ids)
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.tmpl": {Data: []byte(`<a href="{{.url | safeURL}}">{{.title | default "Redirecting"}}</a>` +
+			`{{date "2006-01-02 15:04" .created .tz}} {{.url | urlencode}} {{base64 "ab"}} {{shout "hi"}}`)},
+		"plain.txt.tmpl": {Data: []byte(`{{json .}}`)},
+	}
+
+	storage := NewFS(fsys)
+	storage.Funcs(htmltemplate.FuncMap{"shout": strings.ToUpper})
+
+	payload := map[string]interface{}{
+		"url":     "javascript:alert(1)",
+		"title":   "",
+		"created": float64(0),
+		"tz":      "Europe/Moscow",
+	}
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"page", `<a href="javascript:alert%281%29">Redirecting</a>1970-01-01 03:00 javascript%3Aalert%281%29 YWI= HI`},
+		{"plain", `{"created":0,"title":"","tz":"Europe/Moscow","url":"javascript:alert(1)"}`},
+	}
+	for _, test := range tests {
+		tmpl, err := storage.Template(test.id)
+		if err != nil {
+			t.Errorf("TemplateStorage.Template(%q) return error: %v", test.id, err)
+			continue
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, payload); err != nil || b.String() != test.expected {
+			t.Errorf("Wrong %q template result %s, %v", test.id, b.String(), err)
+		}
+	}
+}
+
+func TestPrecompile(t *testing.T) {
+	fsys := fstest.MapFS{
+		"good.tmpl":          {Data: []byte(`{{.}}`)},
+		"example/bad.tmpl":   {Data: []byte(`{{ .`)},
+		"example/worse.tmpl": {Data: []byte(`{{ undefined }}`)},
+	}
+	storage := NewFS(fsys)
+
+	if _, err := storage.Template("missing"); !errors.Is(err, ERR_NOT_FOUND) {
+		t.Errorf("ERR_NOT_FOUND is expected, got %v", err)
+	}
+	if _, err := storage.Template("example/bad"); !errors.Is(err, ERR_PARSE_ERROR) {
+		t.Errorf("ERR_PARSE_ERROR is expected, got %v", err)
+	}
+
+	err := storage.Precompile()
+	if !errors.Is(err, ERR_PARSE_ERROR) || !strings.Contains(err.Error(), "example/bad") || !strings.Contains(err.Error(), "example/worse") {
+		t.Errorf("Precompile must report all broken templates, got %v", err)
+	}
+
+	delete(fsys, "example/bad.tmpl")
+	delete(fsys, "example/worse.tmpl")
+	if err := NewFS(fsys).Precompile(); err != nil {
+		t.Errorf("Precompile returns error: %v", err)
+	}
+
+	//a broken sibling is found even though the template resolved by its id is valid
+	fsys["page.tmpl"] = &fstest.MapFile{Data: []byte(`{{.}}`)}
+	fsys["page.txt.tmpl"] = &fstest.MapFile{Data: []byte(`{{ .`)}
+	if err := NewFS(fsys).Precompile(); !errors.Is(err, ERR_PARSE_ERROR) || !strings.Contains(err.Error(), "page.txt.tmpl") {
+		t.Errorf("Precompile must report the broken sibling, got %v", err)
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	fsys := fstest.MapFS{
+		"yaml.tmpl": {Data: []byte("---\nkind: text\nextensions: [html, htm]\nrequired: [url]\nmax_size: 100\ncache_ttl: 1h\n---\n<{{.url}}>")},
+		"toml.tmpl": {Data: []byte("+++\nkind = \"html\"\nextensions = [\"txt\"]\n+++\n<{{.url}}>")},
+		"line.tmpl": {Data: []byte("---\nkind: text\n---\n\n{{ .")},
+		"none.tmpl": {Data: []byte("<{{.url}}>")},
+	}
+	storage := NewFS(fsys)
+	payload := map[string]string{"url": "a&b"}
+
+	tests := []struct {
+		id       string
+		expected string
+		meta     *ftp.TemplateMeta
+	}{
+		{"yaml", "<a&b>", &ftp.TemplateMeta{Kind: "text", Extensions: []string{"html", "htm"}, Required: []string{"url"}, MaxSize: 100, CacheTTL: time.Hour}},
+		{"toml", "&lt;a&amp;b>", &ftp.TemplateMeta{Kind: "html", Extensions: []string{"txt"}}},
+		{"none", "&lt;a&amp;b>", nil},
+	}
+	for _, test := range tests {
+		tmpl, err := storage.Template(test.id)
+		if err != nil {
+			t.Errorf("TemplateStorage.Template(%q) return error: %v", test.id, err)
+			continue
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, payload); err != nil || b.String() != test.expected {
+			t.Errorf("Wrong %q template result %s, %v", test.id, b.String(), err)
+		}
+
+		var meta *ftp.TemplateMeta
+		if mt, ok := tmpl.(ftp.MetaTemplate); ok {
+			meta = mt.Meta()
+		}
+		if !reflect.DeepEqual(meta, test.meta) {
+			t.Errorf("Wrong %q template meta %+v", test.id, meta)
+		}
+	}
+
+	//line numbers are kept
+	if _, err := storage.Template("line"); err == nil || !strings.Contains(err.Error(), "line.tmpl:5") {
+		t.Errorf("Parse error must point to the line 5, got %v", err)
+	}
+}